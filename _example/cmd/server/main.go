@@ -1,11 +1,11 @@
 package main
 
 import (
-	"crypto/tls"
 	"flag"
 	"log"
 	"net/http"
 
+	"golang.org/x/crypto/acme/autocert"
 	"google.golang.org/grpc"
 
 	"github.com/offblast/achmed"
@@ -14,6 +14,11 @@ import (
 var (
 	achmedAddress = flag.String("achmed", "127.0.0.1:7654", "achmed address")
 	address       = flag.String("address", ":443", "The server port")
+	httpAddress   = flag.String("http-address", "", "The plain HTTP port answering HTTP-01 challenges")
+	cachedir      = flag.String("cachedir", "", "Directory to keep last known good certificates in")
+	achmedCert    = flag.String("achmed-cert", "", "Client certificate for mutual TLS with achmed")
+	achmedKey     = flag.String("achmed-key", "", "Client key for mutual TLS with achmed")
+	achmedCA      = flag.String("achmed-ca", "", "CA bundle to verify achmed's certificate against")
 )
 
 func handler(w http.ResponseWriter, req *http.Request) {
@@ -24,18 +29,34 @@ func handler(w http.ResponseWriter, req *http.Request) {
 func main() {
 	flag.Parse()
 
-	achmedClient, err := achmed.New(*achmedAddress, grpc.WithInsecure())
+	var achmedClient *achmed.Client
+	var err error
+
+	if *achmedCert != "" {
+		achmedClient, err = achmed.NewTLS(*achmedAddress, *achmedCert, *achmedKey, *achmedCA)
+	} else {
+		achmedClient, err = achmed.New(*achmedAddress, grpc.WithInsecure())
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if *cachedir != "" {
+		achmedClient.Cache = autocert.DirCache(*cachedir)
+	}
+
 	http.HandleFunc("/", handler)
 
 	srv := &http.Server{
-		Addr: *address,
-		TLSConfig: &tls.Config{
-			GetCertificate: achmedClient.GetCertificate,
-		},
+		Addr:      *address,
+		TLSConfig: achmedClient.TLSConfig(),
+	}
+
+	if *httpAddress != "" {
+		go func() {
+			log.Printf("About to listen on %s", *httpAddress)
+			log.Fatal(http.ListenAndServe(*httpAddress, achmedClient.HTTPHandler(nil)))
+		}()
 	}
 
 	log.Printf("About to listen on %s", *address)
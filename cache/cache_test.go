@@ -42,11 +42,34 @@ func testcache(t *testing.T, c autocert.Cache) {
 		t.Fatalf("expected key %q, got %q", tvalue, b)
 	}
 
+	if l, ok := c.(interface {
+		List(context.Context) ([]string, error)
+	}); ok {
+		keys, err := l.List(ctx)
+		if err != nil {
+			t.Fatalf("expected nil error, got %q", err)
+		}
+
+		if len(keys) != 1 || keys[0] != tkey {
+			t.Fatalf("expected keys [%q], got %q", tkey, keys)
+		}
+	}
+
 	if err := c.Delete(ctx, tkey); err != nil {
 		t.Fatalf("expected nil error, got %q", err)
 	}
 }
 
+func TestDirCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "achmed-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testcache(t, DirCache(dir))
+}
+
 func TestMemCache(t *testing.T) {
 	cache := NewMemCache()
 	testcache(t, cache)
@@ -130,6 +153,63 @@ func TestEtcdCache(t *testing.T) {
 	testcache(t, cryptcache)
 }
 
+func TestEtcdHosts(t *testing.T) {
+	etcd, cancel := getEtcd(t)
+	defer cancel()
+
+	url := fmt.Sprintf("http://%s", etcd.Clients[0].Addr())
+	etcdClient, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{url},
+		DialTimeout: 5 * time.Second,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	hosts := NewEtcdHosts(etcdClient)
+	if err := hosts.Add(ctx, "Example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	go hosts.Watch(ctx)
+
+	if err := hosts.HostPolicy(ctx, "example.com"); err != nil {
+		t.Fatalf("expected nil error, got %q", err)
+	}
+
+	if err := hosts.HostPolicy(ctx, "example.org"); err != ErrHostNotListed {
+		t.Fatalf("expected ErrHostNotListed, got %v", err)
+	}
+
+	if err := hosts.Add(ctx, "example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := hosts.Remove(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the watch applies changes asynchronously.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		added := hosts.HostPolicy(ctx, "example.org") == nil
+		removed := hosts.HostPolicy(ctx, "example.com") == ErrHostNotListed
+		if added && removed {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("allowlist not updated: added=%v removed=%v", added, removed)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func TestCryptCache(t *testing.T) {
 	memcache := NewMemCache()
 
@@ -242,3 +322,60 @@ RrY+BHCksJRIE2rbPH2kZXPLi4YrvgeOeMIk0YUVCr5Sj45W2oseECSvkU4eZ6zY
 =Sq5J
 -----END PGP PRIVATE KEY BLOCK-----
 `
+
+func TestEtcdLocker(t *testing.T) {
+	etcd, cancel := getEtcd(t)
+	defer cancel()
+
+	url := fmt.Sprintf("http://%s", etcd.Clients[0].Addr())
+	etcdClient, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{url},
+		DialTimeout: 5 * time.Second,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := &EtcdLocker{Client: etcdClient}
+	ctx := context.Background()
+
+	unlock, err := l.Lock(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// other names are not held up.
+	unlockOther, err := l.Lock(ctx, "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlockOther()
+
+	short, stop := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer stop()
+
+	if _, err := l.Lock(short, "example.com"); err == nil {
+		t.Fatalf("expected held lock to block")
+	}
+
+	locked := make(chan error, 1)
+	go func() {
+		unlock, err := l.Lock(ctx, "example.com")
+		if err == nil {
+			unlock()
+		}
+		locked <- err
+	}()
+
+	unlock()
+
+	select {
+	case err := <-locked:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("lock not handed over after unlock")
+	}
+}
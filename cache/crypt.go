@@ -14,6 +14,7 @@ import (
 var (
 	noDecrypt = errors.New("unable to do decryption")
 	noEncrypt = errors.New("unable to do encryption")
+	noList    = errors.New("unable to list plaintext cache")
 )
 
 type CryptCache struct {
@@ -73,3 +74,15 @@ func (c *CryptCache) Put(ctx context.Context, key string, data []byte) error {
 func (c *CryptCache) Delete(ctx context.Context, key string) error {
 	return c.Plaintext.Delete(ctx, key)
 }
+
+// List returns the keys of all entries, if the plaintext cache can list them.
+func (c *CryptCache) List(ctx context.Context) ([]string, error) {
+	l, ok := c.Plaintext.(interface {
+		List(context.Context) ([]string, error)
+	})
+	if !ok {
+		return nil, noList
+	}
+
+	return l.List(ctx)
+}
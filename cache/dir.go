@@ -0,0 +1,44 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+)
+
+// DirCache is autocert.DirCache that can also list its entries.
+type DirCache string
+
+func (d DirCache) Get(ctx context.Context, key string) ([]byte, error) {
+	return autocert.DirCache(d).Get(ctx, key)
+}
+
+func (d DirCache) Put(ctx context.Context, key string, data []byte) error {
+	return autocert.DirCache(d).Put(ctx, key, data)
+}
+
+func (d DirCache) Delete(ctx context.Context, key string) error {
+	return autocert.DirCache(d).Delete(ctx, key)
+}
+
+// List returns the keys of all entries.
+func (d DirCache) List(ctx context.Context) ([]string, error) {
+	fis, err := ioutil.ReadDir(string(d))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(fis))
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() {
+			keys = append(keys, fi.Name())
+		}
+	}
+
+	return keys, nil
+}
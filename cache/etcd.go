@@ -2,6 +2,7 @@ package cache
 
 import (
 	"path"
+	"strings"
 
 	"github.com/coreos/etcd/clientv3"
 	"golang.org/x/crypto/acme/autocert"
@@ -45,3 +46,19 @@ func (e *EtcdCache) Delete(ctx context.Context, key string) error {
 	_, err := e.Client.Delete(ctx, k)
 	return err
 }
+
+// List returns the keys of all entries.
+func (e *EtcdCache) List(ctx context.Context) ([]string, error) {
+	prefix := mkkey("cache") + "/"
+	r, err := e.Client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(r.Kvs))
+	for _, kv := range r.Kvs {
+		keys = append(keys, strings.TrimPrefix(string(kv.Key), prefix))
+	}
+
+	return keys, nil
+}
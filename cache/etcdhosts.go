@@ -0,0 +1,144 @@
+package cache
+
+import (
+	"errors"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"golang.org/x/net/context"
+)
+
+// ErrHostNotListed is returned by EtcdHosts.HostPolicy for host names
+// that are not in the allowlist.
+var ErrHostNotListed = errors.New("achmed: host not in etcd allowlist")
+
+// etcdRetry is how long EtcdHosts waits before reloading after a failed watch.
+const etcdRetry = 5 * time.Second
+
+// EtcdHosts is a host allowlist kept in etcd. Every key below
+// offblast.org/achmed/hosts/ names an allowed host, values are ignored.
+//
+// Watch keeps an in-memory copy of the allowlist current, so changes
+// made by any replica or by hand take effect without a restart.
+type EtcdHosts struct {
+	Client *clientv3.Client
+
+	mu    sync.RWMutex
+	hosts map[string]bool
+
+	// ready is closed once the allowlist was loaded for the first time.
+	ready     chan struct{}
+	readyOnce sync.Once
+}
+
+func NewEtcdHosts(client *clientv3.Client) *EtcdHosts {
+	return &EtcdHosts{
+		Client: client,
+		hosts:  make(map[string]bool),
+		ready:  make(chan struct{}),
+	}
+}
+
+func hostKey(host string) string {
+	return mkkey("hosts", normalizeHost(host))
+}
+
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// Add allows host.
+func (e *EtcdHosts) Add(ctx context.Context, host string) error {
+	_, err := e.Client.Put(ctx, hostKey(host), "")
+	return err
+}
+
+// Remove disallows host.
+func (e *EtcdHosts) Remove(ctx context.Context, host string) error {
+	_, err := e.Client.Delete(ctx, hostKey(host))
+	return err
+}
+
+// HostPolicy implements autocert.HostPolicy. Until the allowlist was
+// loaded once, it waits for Watch or for ctx to be done.
+func (e *EtcdHosts) HostPolicy(ctx context.Context, host string) error {
+	select {
+	case <-e.ready:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	e.mu.RLock()
+	ok := e.hosts[normalizeHost(host)]
+	e.mu.RUnlock()
+
+	if !ok {
+		return ErrHostNotListed
+	}
+
+	return nil
+}
+
+// Watch loads the allowlist and applies changes to it until ctx is done.
+// If the watch fails, the allowlist is loaded again.
+func (e *EtcdHosts) Watch(ctx context.Context) error {
+	for {
+		err := e.watch(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		log.Printf("achmed: watching etcd host allowlist failed, retrying: %v", err)
+
+		select {
+		case <-time.After(etcdRetry):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (e *EtcdHosts) watch(ctx context.Context) error {
+	prefix := mkkey("hosts") + "/"
+
+	resp, err := e.Client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return err
+	}
+
+	hosts := make(map[string]bool, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		hosts[path.Base(string(kv.Key))] = true
+	}
+
+	e.mu.Lock()
+	e.hosts = hosts
+	e.mu.Unlock()
+
+	e.readyOnce.Do(func() { close(e.ready) })
+
+	wch := e.Client.Watch(ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(resp.Header.Revision+1))
+	for wresp := range wch {
+		if err := wresp.Err(); err != nil {
+			return err
+		}
+
+		e.mu.Lock()
+		for _, ev := range wresp.Events {
+			host := path.Base(string(ev.Kv.Key))
+			switch ev.Type {
+			case clientv3.EventTypePut:
+				e.hosts[host] = true
+			case clientv3.EventTypeDelete:
+				delete(e.hosts, host)
+			}
+		}
+		e.mu.Unlock()
+	}
+
+	return errors.New("watch channel closed")
+}
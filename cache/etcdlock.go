@@ -0,0 +1,56 @@
+package cache
+
+import (
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/concurrency"
+	"golang.org/x/net/context"
+)
+
+const (
+	// defaultLockTTL is how long a lock outlives a crashed holder when
+	// EtcdLocker.TTL is not set, in seconds.
+	defaultLockTTL = 60
+
+	// unlockTimeout bounds releasing a lock.
+	unlockTimeout = 5 * time.Second
+)
+
+// EtcdLocker hands out locks kept in etcd under offblast.org/achmed/locks/,
+// so that replicas sharing an EtcdCache take turns ordering a certificate.
+type EtcdLocker struct {
+	Client *clientv3.Client
+
+	// TTL is how many seconds a lock is kept after its holder stopped
+	// refreshing it, e.g. because it crashed. If zero, 60 seconds are used.
+	TTL int
+}
+
+// Lock blocks until it holds the lock called name or ctx is done. The
+// returned function releases the lock.
+func (l *EtcdLocker) Lock(ctx context.Context, name string) (func(), error) {
+	ttl := l.TTL
+	if ttl <= 0 {
+		ttl = defaultLockTTL
+	}
+
+	s, err := concurrency.NewSession(l.Client, concurrency.WithTTL(ttl))
+	if err != nil {
+		return nil, err
+	}
+
+	m := concurrency.NewMutex(s, mkkey("locks", name))
+	if err := m.Lock(ctx); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), unlockTimeout)
+		defer cancel()
+
+		m.Unlock(ctx)
+		s.Close()
+	}, nil
+}
@@ -45,3 +45,16 @@ func (m *MemCache) Delete(ctx context.Context, key string) error {
 
 	return nil
 }
+
+// List returns the keys of all entries.
+func (m *MemCache) List(ctx context.Context) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := make([]string, 0, len(m.m))
+	for k := range m.m {
+		keys = append(keys, k)
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,90 @@
+package achmed
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/offblast/achmed/proto"
+)
+
+// challengePath is where HTTP-01 challenge responses are served.
+const challengePath = "/.well-known/acme-challenge/"
+
+// HTTPHandler returns a handler that answers HTTP-01 challenge requests
+// with key authorizations from the achmed server, and passes all other
+// requests to fallback. If fallback is nil, other requests are redirected
+// to HTTPS.
+//
+// It is meant to be mounted on the plain HTTP listener of every frontend
+// behind a load balancer, like autocert.Manager.HTTPHandler.
+func (c *Client) HTTPHandler(fallback http.Handler) http.Handler {
+	if fallback == nil {
+		fallback = http.HandlerFunc(redirectHTTPS)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, challengePath) {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		timeout := c.Timeout
+		if timeout <= 0 {
+			timeout = defaultTimeout
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		req := &proto.HTTPChallengeRequest{
+			Host:  host,
+			Token: strings.TrimPrefix(r.URL.Path, challengePath),
+		}
+
+		resp, err := c.ac.GetHTTPChallenge(ctx, req)
+		if err != nil {
+			code := http.StatusBadGateway
+			switch grpc.Code(err) {
+			case codes.NotFound, codes.InvalidArgument:
+				code = http.StatusNotFound
+			case codes.PermissionDenied:
+				code = http.StatusForbidden
+			}
+			// the error may name hosts and policies the requester has no
+			// business seeing, unknown tokens aren't worth a log line.
+			if code != http.StatusNotFound {
+				log.Printf("achmed: failed to get HTTP challenge for %q: %v", host, err)
+			}
+			http.Error(w, http.StatusText(code), code)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(resp.Keyauthorization)
+	})
+}
+
+func redirectHTTPS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Use HTTPS", http.StatusBadRequest)
+		return
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusFound)
+}
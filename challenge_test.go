@@ -0,0 +1,103 @@
+package achmed
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/offblast/achmed/server"
+)
+
+func TestHTTPHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "achmed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a token of a challenge autocert is answering.
+	cache := autocert.DirCache(dir)
+	if err := cache.Put(context.Background(), "t0ken+http-01", []byte("t0ken.s3cret")); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := (&server.HostRules{Exact: []string{"example.com"}}).HostPolicy()
+	a, err := server.New("", cache, nil, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gs := grpc.NewServer()
+	a.Register(gs)
+	go gs.Serve(lis)
+	defer gs.Stop()
+
+	c, err := New(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	srv := httptest.NewServer(c.HTTPHandler(fallback))
+	defer srv.Close()
+
+	tests := []struct {
+		host, path string
+		code       int
+		body       string
+	}{
+		{"example.com", "/.well-known/acme-challenge/t0ken", http.StatusOK, "t0ken.s3cret"},
+		{"example.org", "/.well-known/acme-challenge/t0ken", http.StatusForbidden, "Forbidden\n"},
+		{"example.com", "/.well-known/acme-challenge/unknown", http.StatusNotFound, "Not Found\n"},
+		{"example.com", "/.well-known/acme-challenge/t0ken/x", http.StatusNotFound, ""},
+		{"example.com", "/.well-known/acme-challenge/", http.StatusNotFound, ""},
+		{"example.com", "/index.html", http.StatusTeapot, ""},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", srv.URL+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = tt.host
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != tt.code || tt.body != "" && string(body) != tt.body {
+			t.Errorf("GET http://%s%s = %d %q, want %d %q", tt.host, tt.path, resp.StatusCode, body, tt.code, tt.body)
+		}
+	}
+
+	// without a fallback, other requests are redirected to HTTPS.
+	w := httptest.NewRecorder()
+	c.HTTPHandler(nil).ServeHTTP(w, httptest.NewRequest("GET", "http://example.com:80/index.html?q=1", nil))
+
+	if loc := w.Header().Get("Location"); w.Code != http.StatusFound || loc != "https://example.com/index.html?q=1" {
+		t.Fatalf("expected redirect to HTTPS, got %d %q", w.Code, loc)
+	}
+}
@@ -4,24 +4,133 @@ import (
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
 	"fmt"
-	"sort"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/net/context"
+	"golang.org/x/sync/singleflight"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
 
 	"github.com/offblast/achmed/proto"
 )
 
+const (
+	// defaultRenewBefore is how long before expiry the client starts
+	// refreshing a certificate when Client.RenewBefore is not set.
+	defaultRenewBefore = 29 * 24 * time.Hour
+
+	// refreshRetry is how long the client waits before asking again when
+	// the server handed back a certificate that is still due for renewal.
+	refreshRetry = time.Hour
+
+	// staleRetry is how long the client waits before asking again after
+	// the server could not be reached.
+	staleRetry = time.Minute
+
+	// defaultTimeout bounds each RPC when Client.Timeout is not set.
+	defaultTimeout = 30 * time.Second
+
+	// defaultBackoff is the first retry delay when Client.Backoff is not set.
+	defaultBackoff = time.Second
+
+	// maxBackoff caps the delay between retries.
+	maxBackoff = 30 * time.Second
+
+	// maxWatches is the most certificates watched by one stream, as
+	// the server rejects larger streams.
+	maxWatches = 1000
+)
+
+// watchDelay is how long the client waits for further new certificates
+// before restarting its watch streams.
+var watchDelay = 5 * time.Second
+
+var (
+	// ErrTimeout is returned when no certificate could be obtained
+	// before the handshake deadline or Client.Timeout expired.
+	ErrTimeout = errors.New("achmed: timed out waiting for certificate")
+
+	// ErrCanceled is returned when the handshake was canceled while
+	// waiting for a certificate.
+	ErrCanceled = errors.New("achmed: canceled while waiting for certificate")
+)
+
 type Client struct {
 	c  *grpc.ClientConn
 	ac proto.AchmedClient
+
+	// RenewBefore is how long before a certificate's NotAfter the client
+	// fetches a replacement in the background.
+	// If zero, 29 days are used.
+	RenewBefore time.Duration
+
+	// Cache optionally persists certificates received from the server,
+	// e.g. autocert.DirCache, so they can be served after a restart
+	// while the server is unreachable.
+	Cache autocert.Cache
+
+	// OnError, if not nil, is called whenever a certificate could not be
+	// fetched from the server. If a last known good certificate is
+	// available it is served in the meantime and marked as stale.
+	OnError func(name string, err error)
+
+	// Timeout bounds each GetCertificate RPC to the server.
+	// If zero, 30 seconds are used.
+	Timeout time.Duration
+
+	// Retries is how many times a failed RPC is retried when the server
+	// is unavailable or timed out. Zero means no retries.
+	Retries int
+
+	// Backoff is the delay before the first retry. It doubles with
+	// every further retry, up to 30 seconds.
+	// If zero, 1 second is used.
+	Backoff time.Duration
+
+	mu    sync.Mutex
+	certs map[string]*clientCert
+
+	// group coalesces concurrent fetches of the same certificate.
+	group singleflight.Group
+
+	// changed restarts the watch once a certificate for a new key is
+	// held, done stops it.
+	watchStart sync.Once
+	changed    chan struct{}
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+// clientCert is a parsed certificate held by the Client.
+type clientCert struct {
+	cert *tls.Certificate
+
+	// key and chi are what the certificate was requested with.
+	key string
+	chi *proto.ClientHelloInfo
+
+	refreshAt  time.Time
+	refreshing bool
+
+	// stale is set when the certificate could not be refreshed from the server.
+	stale bool
 }
 
 func New(address string, opts ...grpc.DialOption) (*Client, error) {
@@ -32,26 +141,655 @@ func New(address string, opts ...grpc.DialOption) (*Client, error) {
 
 	ac := proto.NewAchmedClient(cc)
 
-	return &Client{cc, ac}, nil
+	return &Client{
+		c:       cc,
+		ac:      ac,
+		certs:   make(map[string]*clientCert),
+		changed: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// NewTLS is like New, but dials address over mutual TLS, presenting the
+// client certificate in certFile and keyFile. The server certificate is
+// verified against the CA bundle in caFile, or the system roots if caFile
+// is empty.
+func NewTLS(address, certFile, keyFile, caFile string, opts ...grpc.DialOption) (*Client, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		b, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("achmed: no certificates found in %q", caFile)
+		}
+	}
+
+	opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(config)))
+
+	return New(address, opts...)
 }
 
 func (c *Client) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
 	return c.c.Close()
 }
 
+// TLSConfig returns a tls.Config that gets certificates from c and
+// answers TLS-ALPN-01 challenges.
+func (c *Client) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: c.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1", acme.ALPNProto},
+	}
+}
+
+// GetCertificate implements the tls.Config.GetCertificate hook.
+//
+// Certificates are kept in memory per server name and key type, and
+// concurrent requests for the same certificate share one RPC. Once a
+// certificate is within RenewBefore of its expiry, a replacement is
+// fetched in the background while the current one keeps being served.
+//
+// The certificates held are also watched with the server's
+// WatchCertificates stream, so renewed certificates are swapped in as soon
+// as they are issued, and revoked ones are replaced.
+//
+// If the server cannot be reached, the last known good certificate for
+// the name is served instead, from memory or from Cache.
+//
+// Handshakes offering the "acme-tls/1" protocol get the server's TLS-ALPN-01
+// challenge certificate, which requires acme.ALPNProto in
+// tls.Config.NextProtos, see TLSConfig.
+//
+// The wait for the server ends with the handshake's context, see
+// GetCertificateContext.
 func (c *Client) GetCertificate(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	ctx := clientHello.Context()
+	if ctx == nil {
+		// the hello was not made by crypto/tls.
+		ctx = context.Background()
+	}
+
+	return c.GetCertificateContext(ctx, clientHello)
+}
+
+// GetCertificateContext is like GetCertificate but gives up waiting for
+// the server once ctx is done, returning ErrTimeout or ErrCanceled.
+func (c *Client) GetCertificateContext(ctx context.Context, clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := clientHello.ServerName
+	key := proto.CertKey(clientHello)
 	chi := proto.ClientHelloInfoToProto(clientHello)
-	ctx := context.Background()
 
-	certmsg, err := c.ac.GetCertificate(ctx, chi)
+	// challenge certificates are single use, never keep them.
+	if proto.WantsChallengeCert(clientHello) {
+		certmsg, err := c.fetch(ctx, chi)
+		if err != nil {
+			return nil, handshakeError(err)
+		}
+		return parseChallengeCertificate(certmsg)
+	}
+
+	now := time.Now()
+
+	c.mu.Lock()
+	cc, ok := c.certs[key]
+	if !ok {
+		// a wildcard certificate held for another name may cover this one.
+		cc, ok = c.certs[wildcardKey(key)]
+	}
+	if ok && now.Before(cc.cert.Leaf.NotAfter) {
+		if !cc.refreshing && now.After(cc.refreshAt) {
+			cc.refreshing = true
+			go c.refresh(cc)
+		}
+		c.mu.Unlock()
+		return cc.cert, nil
+	}
+	c.mu.Unlock()
+
+	// the fetch is shared with other handshakes, so it must not be
+	// bound to this one's context.
+	ch := c.group.DoChan(key, func() (interface{}, error) {
+		certmsg, err := c.fetch(context.Background(), chi)
+		if err != nil {
+			c.reportError(name, err)
+
+			if cert, cerr := c.cacheGet(key, name); cerr == nil {
+				c.put(&clientCert{
+					cert:      cert,
+					key:       key,
+					chi:       chi,
+					refreshAt: time.Now().Add(staleRetry),
+					stale:     true,
+				})
+				return cert, nil
+			}
+
+			return nil, err
+		}
+
+		cert, err := parseCertificate(name, certmsg)
+		if err != nil {
+			return nil, err
+		}
+
+		c.store(key, chi, cert)
+		c.cachePut(key, certmsg)
+		return cert, nil
+	})
+
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, handshakeError(res.Err)
+		}
+		return res.Val.(*tls.Certificate), nil
+	case <-ctx.Done():
+		return nil, handshakeError(ctx.Err())
+	}
+}
+
+// Stale reports whether a certificate held for name is a last known
+// good certificate that could not be refreshed from the server.
+func (c *Client) Stale(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range []string{name, name + "+rsa"} {
+		if cc, ok := c.certs[key]; ok && cc.stale {
+			return true
+		}
+		if cc, ok := c.certs[wildcardKey(key)]; ok && cc.stale {
+			return true
+		}
+	}
+
+	return false
+}
+
+// refresh fetches a replacement for cc and swaps it in.
+// Only one refresh per certificate runs at a time, see clientCert.refreshing.
+func (c *Client) refresh(cc *clientCert) {
+	name := cc.chi.Servername
+
+	certmsg, err := c.fetch(context.Background(), cc.chi)
+	if err != nil {
+		c.reportError(name, err)
+
+		c.mu.Lock()
+		cc.refreshing = false
+		cc.refreshAt = time.Now().Add(staleRetry)
+		cc.stale = true
+		c.mu.Unlock()
+		return
+	}
+
+	cert, err := parseCertificate(name, certmsg)
+	if err != nil {
+		log.Printf("achmed: failed to refresh certificate for %q: %v", name, err)
+
+		c.mu.Lock()
+		cc.refreshing = false
+		cc.refreshAt = time.Now().Add(refreshRetry)
+		c.mu.Unlock()
+		return
+	}
+
+	c.store(cc.key, cc.chi, cert)
+	c.cachePut(cc.key, certmsg)
+}
+
+// store keeps cert in memory under key and schedules its refresh.
+func (c *Client) store(key string, chi *proto.ClientHelloInfo, cert *tls.Certificate) {
+	refreshAt := cert.Leaf.NotAfter.Add(-c.renewBefore())
+	if now := time.Now(); refreshAt.Before(now) {
+		// the server has not renewed yet, don't ask again right away.
+		refreshAt = now.Add(refreshRetry)
+	}
+
+	c.put(&clientCert{
+		cert:      cert,
+		key:       key,
+		chi:       chi,
+		refreshAt: refreshAt,
+	})
+}
+
+// put stores cc under its key and under the wildcard keys of the
+// names it covers, so the certificate is reused for other subdomains.
+func (c *Client) put(cc *clientCert) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.certs[cc.key]; !ok {
+		c.watchChanged()
+	}
+	c.certs[cc.key] = cc
+
+	var suffix string
+	if strings.HasSuffix(cc.key, "+rsa") {
+		suffix = "+rsa"
+	}
+	for _, n := range cc.cert.Leaf.DNSNames {
+		if strings.HasPrefix(n, "*.") {
+			c.certs[strings.ToLower(n)+suffix] = cc
+		}
+	}
+}
+
+// watchChanged starts watching the certificates held, or restarts the
+// watch to include a new one.
+func (c *Client) watchChanged() {
+	started := false
+	c.watchStart.Do(func() {
+		started = true
+		go c.watch()
+	})
+
+	if !started {
+		select {
+		case c.changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// watch keeps WatchCertificates streams open for the certificates held,
+// until c is closed. It gives up if the server does not implement it,
+// leaving it to GetCertificate to refresh certificates.
+func (c *Client) watch() {
+	for {
+		// certificates tend to be fetched in bursts, restart the streams
+		// once for all of them.
+		select {
+		case <-time.After(watchDelay):
+		case <-c.done:
+			return
+		}
+
+		select {
+		case <-c.changed:
+		default:
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		// the server limits the certificates watched by one stream.
+		watches := c.watches()
+		stopped := make(chan error, len(watches)/maxWatches+1)
+		for len(watches) > 0 {
+			n := len(watches)
+			if n > maxWatches {
+				n = maxWatches
+			}
+
+			go func(batch []*proto.Watch) {
+				stopped <- c.watchBatch(ctx, batch)
+			}(watches[:n])
+			watches = watches[n:]
+		}
+
+		select {
+		case <-c.changed:
+			cancel()
+		case <-c.done:
+			cancel()
+			return
+		case <-stopped:
+			cancel()
+			log.Printf("achmed: server can't watch certificates, polling instead")
+			return
+		}
+	}
+}
+
+// watchBatch keeps a stream open for watches until ctx is done, retrying
+// failed streams. It only returns early if the server does not implement
+// WatchCertificates.
+func (c *Client) watchBatch(ctx context.Context, watches []*proto.Watch) error {
+	backoff := c.Backoff
+	if backoff <= 0 {
+		backoff = defaultBackoff
+	}
+
+	for {
+		start := time.Now()
+		err := c.watchStream(ctx, watches)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		switch grpc.Code(err) {
+		case codes.Unimplemented:
+			return err
+		case codes.PermissionDenied, codes.InvalidArgument:
+			// asking again won't help until the certificates held change.
+			log.Printf("achmed: server refused to watch certificates: %v", err)
+			<-ctx.Done()
+			return nil
+		}
+
+		log.Printf("achmed: failed to watch certificates: %v", err)
+
+		if time.Since(start) > maxBackoff {
+			backoff = c.Backoff
+			if backoff <= 0 {
+				backoff = defaultBackoff
+			}
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil
+		}
+
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// watchStream watches certificates until the stream fails or ctx is done.
+func (c *Client) watchStream(ctx context.Context, watches []*proto.Watch) error {
+	stream, err := c.ac.WatchCertificates(ctx, &proto.WatchRequest{Watches: watches})
+	if err != nil {
+		return err
+	}
+
+	for {
+		ev, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		c.update(ev)
+	}
+}
+
+// watches returns a watch for every certificate held.
+func (c *Client) watches() []*proto.Watch {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var watches []*proto.Watch
+
+	// wildcard certificates are held under several keys.
+	seen := make(map[*clientCert]bool)
+	for _, cc := range c.certs {
+		if seen[cc] {
+			continue
+		}
+		seen[cc] = true
+
+		watches = append(watches, &proto.Watch{Hello: cc.chi, Fingerprint: fingerprint(cc.cert.Leaf.Raw)})
+	}
+
+	return watches
+}
+
+// update swaps in the certificate of a watch event, or fetches a new one
+// if the certificate was revoked.
+func (c *Client) update(ev *proto.CertificateEvent) {
+	if ev.Hello == nil {
+		return
+	}
+
+	key := proto.CertKey(proto.ProtoToClientHelloInfo(ev.Hello))
+	name := ev.Hello.Servername
+
+	if ev.Revoked {
+		c.mu.Lock()
+		if cc, ok := c.certs[key]; ok && !cc.refreshing {
+			cc.refreshing = true
+			go c.refresh(cc)
+		}
+		c.mu.Unlock()
+		return
+	}
+
+	if ev.Certificate == nil {
+		return
+	}
+
+	cert, err := parseCertificate(name, ev.Certificate)
+	if err != nil {
+		log.Printf("achmed: failed to update certificate for %q: %v", name, err)
+		return
+	}
+
+	c.store(key, ev.Hello, cert)
+	c.cachePut(key, ev.Certificate)
+}
+
+// fingerprint returns the hex encoded SHA-256 hash of a DER certificate,
+// like proto.Certificate.Fingerprint.
+func fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// wildcardKey returns the key a wildcard certificate covering the
+// name in key is stored under.
+func wildcardKey(key string) string {
+	var suffix string
+	if strings.HasSuffix(key, "+rsa") {
+		key = strings.TrimSuffix(key, "+rsa")
+		suffix = "+rsa"
+	}
+
+	i := strings.IndexByte(key, '.')
+	if i <= 0 {
+		return ""
+	}
+
+	return "*" + strings.ToLower(key[i:]) + suffix
+}
+
+func (c *Client) renewBefore() time.Duration {
+	if c.RenewBefore > 0 {
+		return c.RenewBefore
+	}
+	return defaultRenewBefore
+}
+
+func (c *Client) reportError(name string, err error) {
+	log.Printf("achmed: failed to get certificate for %q: %v", name, err)
+
+	if c.OnError != nil {
+		c.OnError(name, err)
+	}
+}
+
+func (c *Client) cacheGet(key, name string) (*tls.Certificate, error) {
+	if c.Cache == nil {
+		return nil, autocert.ErrCacheMiss
+	}
+
+	data, err := c.Cache.Get(context.Background(), key)
 	if err != nil {
 		return nil, err
 	}
 
+	return parseCertificate(name, &proto.Certificate{Pem: data})
+}
+
+func (c *Client) cachePut(key string, certmsg *proto.Certificate) {
+	if c.Cache == nil {
+		return
+	}
+
+	data := certmsg.Pem
+	if len(data) == 0 {
+		data = encodePEM(certmsg)
+	}
+
+	if err := c.Cache.Put(context.Background(), key, data); err != nil {
+		log.Printf("achmed: failed to cache certificate %q: %v", key, err)
+	}
+}
+
+// fetch requests a certificate from the achmed server, retrying
+// temporary failures until ctx is done.
+func (c *Client) fetch(ctx context.Context, chi *proto.ClientHelloInfo) (*proto.Certificate, error) {
+	backoff := c.Backoff
+	if backoff <= 0 {
+		backoff = defaultBackoff
+	}
+
+	for attempt := 0; ; attempt++ {
+		certmsg, hint, err := c.fetchOnce(ctx, chi)
+		if err == nil || attempt >= c.Retries || !retryable(err) {
+			return certmsg, err
+		}
+
+		// don't retry early when the server said when to come back,
+		// nor at all when that's too far away.
+		wait := backoff
+		if hint > maxBackoff {
+			return nil, err
+		} else if hint > wait {
+			wait = hint
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// fetchOnce requests a certificate once. On failure it also returns the
+// server's retry-after hint, if any.
+func (c *Client) fetchOnce(ctx context.Context, chi *proto.ClientHelloInfo) (*proto.Certificate, time.Duration, error) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var trailer metadata.MD
+	certmsg, err := c.ac.GetCertificate(ctx, chi, grpc.Trailer(&trailer))
+	if err != nil {
+		return nil, retryAfter(trailer), err
+	}
+
+	return certmsg, 0, nil
+}
+
+// retryAfter returns the retry-after hint in trailer, or zero.
+func retryAfter(trailer metadata.MD) time.Duration {
+	for _, v := range trailer[proto.RetryAfterKey] {
+		if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+			return time.Duration(secs) * time.Second
+		}
+	}
+	return 0
+}
+
+// retryable reports whether a failed RPC is worth retrying.
+func retryable(err error) bool {
+	switch grpc.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+// handshakeError maps deadline and cancellation errors, either local
+// or from the server, to ErrTimeout and ErrCanceled.
+func handshakeError(err error) error {
+	switch {
+	case err == context.DeadlineExceeded, grpc.Code(err) == codes.DeadlineExceeded:
+		return ErrTimeout
+	case err == context.Canceled, grpc.Code(err) == codes.Canceled:
+		return ErrCanceled
+	}
+	return err
+}
+
+// parseCertificate parses certmsg and verifies it is currently valid for name.
+func parseCertificate(name string, certmsg *proto.Certificate) (*tls.Certificate, error) {
+	cert, err := parseKeyPair(certmsg)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf := cert.Leaf
+	now := time.Now()
+	if now.Before(leaf.NotBefore) {
+		return nil, errors.New("acme/autocert: certificate is not valid yet")
+	}
+	if now.After(leaf.NotAfter) {
+		return nil, errors.New("acme/autocert: expired certificate")
+	}
+	if !domainMatch(leaf, name) {
+		return nil, errors.New("acme/autocert: certificate does not match domain name")
+	}
+
+	return cert, nil
+}
+
+// parseChallengeCertificate parses a TLS-ALPN-01 challenge certificate.
+// Challenge certificates are self-signed for the name being validated and
+// only ever shown to the ACME server, so only the key pair is verified.
+func parseChallengeCertificate(certmsg *proto.Certificate) (*tls.Certificate, error) {
+	return parseKeyPair(certmsg)
+}
+
+// parseKeyPair parses certmsg and verifies that the leaf belongs to the
+// private key. The structured fields are used when the server sent them,
+// the PEM blob otherwise.
+func parseKeyPair(certmsg *proto.Certificate) (*tls.Certificate, error) {
+	if len(certmsg.Chain) == 0 || len(certmsg.Privatekey) == 0 {
+		return parsePEM(certmsg.Pem)
+	}
+
+	privKey, err := parsePrivateKey(certmsg.Privatekey)
+	if err != nil {
+		return nil, err
+	}
+
+	var pubDER []byte
+	for _, b := range certmsg.Chain {
+		pubDER = append(pubDER, b...)
+	}
+
+	cert, err := newKeyPair(privKey, pubDER)
+	if err != nil {
+		return nil, err
+	}
+
+	cert.OCSPStaple = certmsg.Ocspstaple
+	return cert, nil
+}
+
+// parsePEM parses a private key PEM block followed by certificate PEM blocks.
+func parsePEM(data []byte) (*tls.Certificate, error) {
 	// below is yanked from golang.org/x/crypto/acme/autocert/autocert.go
 
 	// private
-	priv, pub := pem.Decode(certmsg.Pem)
+	priv, pub := pem.Decode(data)
 	if priv == nil || !strings.Contains(priv.Type, "PRIVATE") {
 		return nil, fmt.Errorf("achmed: invalid private key")
 	}
@@ -71,26 +809,29 @@ func (c *Client) GetCertificate(clientHello *tls.ClientHelloInfo) (*tls.Certific
 		pubDER = append(pubDER, b.Bytes...)
 	}
 
-	// parse public part(s) and verify the leaf is not expired
-	// and corresponds to the private key
-	x509Cert, err := x509.ParseCertificates(pubDER)
-	if len(x509Cert) == 0 {
-		return nil, errors.New("acme/autocert: no public key found in cache")
-	}
-	leaf := x509Cert[0]
-	now := time.Now()
-	if now.Before(leaf.NotBefore) {
-		return nil, errors.New("acme/autocert: certificate is not valid yet")
-	}
+	return newKeyPair(privKey, pubDER)
+}
 
-	// only check if this is not a challenge.
-	if !strings.HasSuffix(clientHello.ServerName, ".acme.invalid") && now.After(leaf.NotAfter) {
-		return nil, errors.New("acme/autocert: expired certificate")
+// encodePEM encodes the structured fields of certmsg as a private key
+// PEM block followed by certificate PEM blocks.
+func encodePEM(certmsg *proto.Certificate) []byte {
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: certmsg.Privatekey})
+	for _, b := range certmsg.Chain {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b})...)
 	}
+	return data
+}
 
-	if !domainMatch(leaf, clientHello.ServerName) {
-		return nil, errors.New("acme/autocert: certificate does not match domain name")
+// newKeyPair parses the concatenated DER certificates in pubDER and
+// verifies that the leaf belongs to privKey.
+func newKeyPair(privKey crypto.PrivateKey, pubDER []byte) (*tls.Certificate, error) {
+	// parse public part(s) and verify the leaf
+	// corresponds to the private key
+	x509Cert, err := x509.ParseCertificates(pubDER)
+	if err != nil || len(x509Cert) == 0 {
+		return nil, errors.New("acme/autocert: no public key found in cache")
 	}
+	leaf := x509Cert[0]
 	switch pub := leaf.PublicKey.(type) {
 	case *rsa.PublicKey:
 		prv, ok := privKey.(*rsa.PrivateKey)
@@ -147,15 +888,52 @@ func parsePrivateKey(der []byte) (crypto.PrivateKey, error) {
 	return nil, errors.New("acme/autocert: failed to parse private key")
 }
 
-// domainMatch matches cert against the specified domain name.
-// It doesn't support wildcard.
-//
-// Copied from golang.org/x/crypto/acme/autocert/autocert.go.
+// domainMatch matches cert against the specified domain name or IP address,
+// following RFC 6125. The common name is only consulted when the certificate
+// has no DNS names.
 func domainMatch(cert *x509.Certificate, name string) bool {
-	if cert.Subject.CommonName == name {
+	if ip := net.ParseIP(name); ip != nil {
+		for _, addr := range cert.IPAddresses {
+			if addr.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, n := range cert.DNSNames {
+		if hostnameMatch(n, name) {
+			return true
+		}
+	}
+
+	return len(cert.DNSNames) == 0 && hostnameMatch(cert.Subject.CommonName, name)
+}
+
+// hostnameMatch matches a reference identifier from a certificate against
+// host. A wildcard is only allowed as the complete left-most label and
+// matches exactly one label, see RFC 6125 section 6.4.3.
+func hostnameMatch(pattern, host string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if pattern == "" || host == "" {
+		return false
+	}
+
+	if pattern == host {
 		return true
 	}
-	sort.Strings(cert.DNSNames)
-	i := sort.SearchStrings(cert.DNSNames, name)
-	return i < len(cert.DNSNames) && cert.DNSNames[i] == name
+
+	// refuse wildcards directly below a top level domain, like *.com.
+	if !strings.HasPrefix(pattern, "*.") || strings.Count(pattern, ".") < 2 {
+		return false
+	}
+
+	i := strings.IndexByte(host, '.')
+	if i <= 0 {
+		return false
+	}
+
+	return host[i:] == pattern[1:]
 }
@@ -0,0 +1,695 @@
+package achmed
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/offblast/achmed/proto"
+)
+
+// testAchmedClient is a proto.AchmedClient answering GetCertificate calls
+// with getCertificate, and counting them. WatchCertificates calls are
+// answered with watchCertificates, if set.
+type testAchmedClient struct {
+	getCertificate    func(ctx context.Context, chi *proto.ClientHelloInfo) (*proto.Certificate, error)
+	watchCertificates func(ctx context.Context, req *proto.WatchRequest) (proto.Achmed_WatchCertificatesClient, error)
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (ac *testAchmedClient) GetCertificate(ctx context.Context, chi *proto.ClientHelloInfo, opts ...grpc.CallOption) (*proto.Certificate, error) {
+	ac.mu.Lock()
+	ac.calls++
+	ac.mu.Unlock()
+
+	return ac.getCertificate(ctx, chi)
+}
+
+func (ac *testAchmedClient) GetHTTPChallenge(ctx context.Context, req *proto.HTTPChallengeRequest, opts ...grpc.CallOption) (*proto.HTTPChallengeResponse, error) {
+	return nil, grpc.Errorf(codes.Unimplemented, "not implemented")
+}
+
+func (ac *testAchmedClient) WatchCertificates(ctx context.Context, req *proto.WatchRequest, opts ...grpc.CallOption) (proto.Achmed_WatchCertificatesClient, error) {
+	if ac.watchCertificates != nil {
+		return ac.watchCertificates(ctx, req)
+	}
+
+	return nil, grpc.Errorf(codes.Unimplemented, "not implemented")
+}
+
+// testWatchStream is a watch stream without events, open until its
+// context is done.
+type testWatchStream struct {
+	grpc.ClientStream
+	ctx context.Context
+}
+
+func (s *testWatchStream) Recv() (*proto.CertificateEvent, error) {
+	<-s.ctx.Done()
+	return nil, s.ctx.Err()
+}
+
+func (ac *testAchmedClient) numCalls() int {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	return ac.calls
+}
+
+// newTestClient returns a Client using ac that does not watch certificates.
+func newTestClient(ac proto.AchmedClient) *Client {
+	c := &Client{
+		ac:      ac,
+		certs:   make(map[string]*clientCert),
+		changed: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	c.watchStart.Do(func() {})
+
+	return c
+}
+
+// selfSigned returns a certificate message for a self-signed ECDSA
+// certificate valid for names, with only the structured fields set.
+func selfSigned(t *testing.T, notAfter time.Time, names ...string) *proto.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &proto.Certificate{
+		Chain:      [][]byte{der},
+		Privatekey: pkcs8,
+	}
+}
+
+func TestParseCertificate(t *testing.T) {
+	certmsg := selfSigned(t, time.Now().Add(time.Hour), "example.com", "*.example.com")
+
+	if _, err := parseCertificate("www.example.com", certmsg); err != nil {
+		t.Fatalf("expected nil error for structured certificate, got %q", err)
+	}
+
+	// older servers only send the PEM blob.
+	legacy := &proto.Certificate{Pem: encodePEM(certmsg)}
+	if _, err := parseCertificate("www.example.com", legacy); err != nil {
+		t.Fatalf("expected nil error for PEM certificate, got %q", err)
+	}
+
+	if _, err := parseCertificate("example.org", certmsg); err == nil {
+		t.Fatalf("expected error for wrong name")
+	}
+
+	if b, _ := pem.Decode(legacy.Pem); b == nil || b.Type != "PRIVATE KEY" {
+		t.Fatalf("expected private key block first")
+	}
+}
+
+func TestParseCertificateExpired(t *testing.T) {
+	certmsg := selfSigned(t, time.Now().Add(-time.Minute), "example.com")
+
+	if _, err := parseCertificate("example.com", certmsg); err == nil {
+		t.Fatalf("expected error for expired certificate")
+	}
+
+	// challenge certificates are not checked for expiry.
+	if _, err := parseChallengeCertificate(certmsg); err != nil {
+		t.Fatalf("expected nil error for challenge certificate, got %q", err)
+	}
+}
+
+func TestDomainMatch(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "example.com"},
+		DNSNames:    []string{"example.com", "*.Example.com", "*.api.example.org"},
+		IPAddresses: []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")},
+	}
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"example.com", true},
+		{"EXAMPLE.com.", true},
+		{"www.example.com", true},
+		{"WWW.example.com", true},
+		{"a.b.example.com", false},
+		{"api.example.org", false},
+		{"v1.api.example.org", true},
+		{"example.org", false},
+		{".example.com", false},
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"2001:db8::1", true},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := domainMatch(cert, tt.name); got != tt.want {
+			t.Errorf("domainMatch(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDomainMatchCommonName(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject: pkix.Name{CommonName: "*.example.com"},
+	}
+
+	if !domainMatch(cert, "www.example.com") {
+		t.Errorf("expected common name to match without DNS names")
+	}
+
+	cert.DNSNames = []string{"example.net"}
+	if domainMatch(cert, "www.example.com") {
+		t.Errorf("expected common name to be ignored with DNS names")
+	}
+}
+
+func TestHostnameMatchTLD(t *testing.T) {
+	if hostnameMatch("*.com", "example.com") {
+		t.Errorf("expected wildcard below a top level domain not to match")
+	}
+}
+
+func TestWildcardKey(t *testing.T) {
+	tests := []struct {
+		key, want string
+	}{
+		{"www.example.com", "*.example.com"},
+		{"www.Example.com+rsa", "*.example.com+rsa"},
+		{"localhost", ""},
+	}
+
+	for _, tt := range tests {
+		if got := wildcardKey(tt.key); got != tt.want {
+			t.Errorf("wildcardKey(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	if d := retryAfter(metadata.Pairs(proto.RetryAfterKey, "3")); d != 3*time.Second {
+		t.Errorf("expected 3s, got %s", d)
+	}
+
+	if d := retryAfter(metadata.Pairs(proto.RetryAfterKey, "soon")); d != 0 {
+		t.Errorf("expected no hint for invalid value, got %s", d)
+	}
+
+	if d := retryAfter(nil); d != 0 {
+		t.Errorf("expected no hint without trailer, got %s", d)
+	}
+}
+
+func TestGetCertificateContext(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	ac := &testAchmedClient{getCertificate: func(ctx context.Context, chi *proto.ClientHelloInfo) (*proto.Certificate, error) {
+		if chi.Servername == "slow.example.com" {
+			return nil, grpc.Errorf(codes.DeadlineExceeded, "too slow")
+		}
+
+		select {
+		case <-release:
+			return nil, grpc.Errorf(codes.Unavailable, "released")
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}}
+
+	c := newTestClient(ac)
+	c.Timeout = time.Minute
+
+	hello := &tls.ClientHelloInfo{ServerName: "example.com"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.GetCertificateContext(ctx, hello); err != ErrTimeout {
+		t.Fatalf("expected ErrTimeout once the deadline passed, got %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.GetCertificateContext(ctx, hello); err != ErrCanceled {
+		t.Fatalf("expected ErrCanceled for a canceled handshake, got %v", err)
+	}
+
+	if _, err := c.GetCertificateContext(context.Background(), &tls.ClientHelloInfo{ServerName: "slow.example.com"}); err != ErrTimeout {
+		t.Fatalf("expected ErrTimeout for a server timeout, got %v", err)
+	}
+}
+
+func TestGetCertificateHandshakeDeadline(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	c := newTestClient(&testAchmedClient{getCertificate: func(ctx context.Context, chi *proto.ClientHelloInfo) (*proto.Certificate, error) {
+		<-release
+		return nil, grpc.Errorf(codes.Unavailable, "released")
+	}})
+
+	errc := make(chan error, 1)
+	config := c.TLSConfig()
+	config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := c.GetCertificate(hello)
+		errc <- err
+		return cert, err
+	}
+
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+
+	go tls.Client(cconn, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true}).Handshake()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	go tls.Server(sconn, config).HandshakeContext(ctx)
+
+	select {
+	case err := <-errc:
+		if err != ErrTimeout {
+			t.Fatalf("expected ErrTimeout at the handshake deadline, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("GetCertificate ignored the handshake deadline")
+	}
+}
+
+func TestFetchRetries(t *testing.T) {
+	certmsg := selfSigned(t, time.Now().Add(time.Hour), "example.com")
+	chi := &proto.ClientHelloInfo{Servername: "example.com"}
+
+	failing := func(code codes.Code, failures int) *testAchmedClient {
+		ac := &testAchmedClient{}
+		ac.getCertificate = func(ctx context.Context, chi *proto.ClientHelloInfo) (*proto.Certificate, error) {
+			if ac.numCalls() <= failures {
+				return nil, grpc.Errorf(code, "failure")
+			}
+			return certmsg, nil
+		}
+		return ac
+	}
+
+	ac := failing(codes.Unavailable, 2)
+	c := newTestClient(ac)
+	c.Retries = 2
+	c.Backoff = 10 * time.Millisecond
+
+	start := time.Now()
+	if _, err := c.fetch(context.Background(), chi); err != nil {
+		t.Fatalf("expected success after two retries, got %v", err)
+	}
+	if ac.numCalls() != 3 {
+		t.Fatalf("expected 3 calls, got %d", ac.numCalls())
+	}
+	// the backoff doubles: 10ms, then 20ms.
+	if d := time.Since(start); d < 30*time.Millisecond {
+		t.Fatalf("expected retries to back off, took %s", d)
+	}
+
+	ac = failing(codes.Unavailable, 2)
+	c = newTestClient(ac)
+	c.Retries = 1
+	c.Backoff = time.Millisecond
+
+	if _, err := c.fetch(context.Background(), chi); grpc.Code(err) != codes.Unavailable || ac.numCalls() != 2 {
+		t.Fatalf("expected Unavailable after 2 calls, got %v after %d", err, ac.numCalls())
+	}
+
+	ac = failing(codes.PermissionDenied, 1)
+	c = newTestClient(ac)
+	c.Retries = 3
+	c.Backoff = time.Millisecond
+
+	if _, err := c.fetch(context.Background(), chi); grpc.Code(err) != codes.PermissionDenied || ac.numCalls() != 1 {
+		t.Fatalf("expected PermissionDenied without retries, got %v after %d calls", err, ac.numCalls())
+	}
+
+	ac = failing(codes.Unavailable, 10)
+	c = newTestClient(ac)
+	c.Retries = 10
+	c.Backoff = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.fetch(ctx, chi); err != context.DeadlineExceeded || ac.numCalls() != 1 {
+		t.Fatalf("expected the backoff to end with ctx, got %v after %d calls", err, ac.numCalls())
+	}
+}
+
+// renewingAchmedClient returns a testAchmedClient handing out a new
+// certificate for the requested name on every call, valid for 48 hours.
+func renewingAchmedClient(t *testing.T) *testAchmedClient {
+	return &testAchmedClient{getCertificate: func(ctx context.Context, chi *proto.ClientHelloInfo) (*proto.Certificate, error) {
+		return selfSigned(t, time.Now().Add(48*time.Hour), chi.Servername), nil
+	}}
+}
+
+func TestClientRefresh(t *testing.T) {
+	ac := renewingAchmedClient(t)
+	c := newTestClient(ac)
+	c.RenewBefore = 24 * time.Hour
+
+	hello := &tls.ClientHelloInfo{ServerName: "example.com"}
+	key := proto.CertKey(hello)
+
+	first, err := c.GetCertificateContext(context.Background(), hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.mu.Lock()
+	refreshAt := c.certs[key].refreshAt
+	c.mu.Unlock()
+
+	if want := first.Leaf.NotAfter.Add(-c.RenewBefore); !refreshAt.Equal(want) {
+		t.Fatalf("expected refresh at %s, got %s", want, refreshAt)
+	}
+
+	if cert, err := c.GetCertificateContext(context.Background(), hello); err != nil || cert != first || ac.numCalls() != 1 {
+		t.Fatalf("expected certificate from memory, got %v after %d calls", err, ac.numCalls())
+	}
+
+	// RenewBefore has come.
+	c.mu.Lock()
+	c.certs[key].refreshAt = time.Now().Add(-time.Second)
+	c.mu.Unlock()
+
+	if cert, err := c.GetCertificateContext(context.Background(), hello); err != nil || cert != first {
+		t.Fatalf("expected current certificate while refreshing, got %v", err)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		c.mu.Lock()
+		refreshed := c.certs[key].cert != first
+		c.mu.Unlock()
+
+		if refreshed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected certificate to be refreshed in the background")
+		}
+	}
+
+	if ac.numCalls() != 2 {
+		t.Fatalf("expected one refresh, got %d calls", ac.numCalls())
+	}
+}
+
+func TestClientStale(t *testing.T) {
+	dir, err := ioutil.TempDir("", "achmed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the server goes away after the first call.
+	ac := &testAchmedClient{}
+	ac.getCertificate = func(ctx context.Context, chi *proto.ClientHelloInfo) (*proto.Certificate, error) {
+		if ac.numCalls() > 1 {
+			return nil, grpc.Errorf(codes.Unavailable, "server down")
+		}
+		return selfSigned(t, time.Now().Add(48*time.Hour), chi.Servername), nil
+	}
+
+	errs := make(chan string, 10)
+	onError := func(name string, err error) {
+		errs <- name
+	}
+
+	c := newTestClient(ac)
+	c.Cache = autocert.DirCache(dir)
+	c.OnError = onError
+
+	hello := &tls.ClientHelloInfo{ServerName: "example.com"}
+	key := proto.CertKey(hello)
+
+	good, err := c.GetCertificateContext(context.Background(), hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Stale("example.com") {
+		t.Fatalf("expected fresh certificate not to be stale")
+	}
+
+	c.mu.Lock()
+	c.certs[key].refreshAt = time.Now().Add(-time.Second)
+	c.mu.Unlock()
+
+	if cert, err := c.GetCertificateContext(context.Background(), hello); err != nil || cert != good {
+		t.Fatalf("expected last known good certificate, got %v", err)
+	}
+
+	select {
+	case name := <-errs:
+		if name != "example.com" {
+			t.Fatalf("expected error for example.com, got %q", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected OnError to be called")
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); !c.Stale("example.com"); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected certificate to be marked stale")
+		}
+	}
+
+	if cert, err := c.GetCertificateContext(context.Background(), hello); err != nil || cert != good {
+		t.Fatalf("expected stale certificate to be served, got %v", err)
+	}
+
+	// after a restart, the certificate comes from the cache.
+	c = newTestClient(ac)
+	c.Cache = autocert.DirCache(dir)
+	c.OnError = onError
+
+	cert, err := c.GetCertificateContext(context.Background(), hello)
+	if err != nil || string(cert.Leaf.Raw) != string(good.Leaf.Raw) {
+		t.Fatalf("expected cached certificate, got %v", err)
+	}
+
+	if !c.Stale("example.com") || <-errs != "example.com" {
+		t.Fatalf("expected cached certificate to be stale and reported")
+	}
+
+	c = newTestClient(ac)
+	if _, err := c.GetCertificateContext(context.Background(), hello); grpc.Code(err) != codes.Unavailable {
+		t.Fatalf("expected error without a cache, got %v", err)
+	}
+}
+
+func TestClientCoalesce(t *testing.T) {
+	release := make(chan struct{})
+
+	ac := &testAchmedClient{getCertificate: func(ctx context.Context, chi *proto.ClientHelloInfo) (*proto.Certificate, error) {
+		<-release
+		return selfSigned(t, time.Now().Add(48*time.Hour), chi.Servername), nil
+	}}
+	c := newTestClient(ac)
+
+	hello := &tls.ClientHelloInfo{ServerName: "example.com"}
+
+	const handshakes = 10
+	certs := make(chan *tls.Certificate, handshakes)
+	for i := 0; i < handshakes; i++ {
+		go func() {
+			cert, err := c.GetCertificateContext(context.Background(), hello)
+			if err != nil {
+				t.Error(err)
+			}
+			certs <- cert
+		}()
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ac.numCalls() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a call to the server")
+		}
+	}
+	// let the other handshakes join the call.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	first := <-certs
+	for i := 1; i < handshakes; i++ {
+		if cert := <-certs; cert != first {
+			t.Fatalf("expected all handshakes to get the same certificate")
+		}
+	}
+
+	if ac.numCalls() != 1 {
+		t.Fatalf("expected one call for concurrent handshakes, got %d", ac.numCalls())
+	}
+}
+
+func TestWatchUpdate(t *testing.T) {
+	c := newTestClient(nil)
+
+	hello := &proto.ClientHelloInfo{Servername: "www.example.com"}
+	key := proto.CertKey(proto.ProtoToClientHelloInfo(hello))
+
+	first := selfSigned(t, time.Now().Add(24*time.Hour), "*.example.com")
+	c.update(&proto.CertificateEvent{Hello: hello, Certificate: first})
+
+	select {
+	case <-c.changed:
+	default:
+		t.Fatalf("expected watch to restart for a new certificate")
+	}
+
+	// the wildcard certificate is held under two keys, but watched once.
+	watches := c.watches()
+	if len(watches) != 1 || watches[0].Hello != hello || watches[0].Fingerprint != fingerprint(first.Chain[0]) {
+		t.Fatalf("expected one watch for the certificate, got %v", watches)
+	}
+
+	second := selfSigned(t, time.Now().Add(48*time.Hour), "*.example.com")
+	c.update(&proto.CertificateEvent{Hello: hello, Certificate: second})
+
+	if cc := c.certs[key]; cc == nil || string(cc.cert.Leaf.Raw) != string(second.Chain[0]) {
+		t.Fatalf("expected renewed certificate to be swapped in")
+	}
+
+	select {
+	case <-c.changed:
+		t.Fatalf("expected no watch restart for a renewed certificate")
+	default:
+	}
+
+	c.update(&proto.CertificateEvent{Hello: hello, Certificate: selfSigned(t, time.Now().Add(time.Hour), "example.org")})
+	if cc := c.certs[key]; string(cc.cert.Leaf.Raw) != string(second.Chain[0]) {
+		t.Fatalf("expected certificate for another name to be ignored")
+	}
+}
+
+func TestWatchStreams(t *testing.T) {
+	defer func(d time.Duration) { watchDelay = d }(watchDelay)
+	watchDelay = 10 * time.Millisecond
+
+	var (
+		mu     sync.Mutex
+		refuse bool
+	)
+
+	streams := make(chan int, 10)
+	ac := &testAchmedClient{
+		watchCertificates: func(ctx context.Context, req *proto.WatchRequest) (proto.Achmed_WatchCertificatesClient, error) {
+			streams <- len(req.Watches)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if refuse || len(req.Watches) > maxWatches {
+				return nil, grpc.Errorf(codes.PermissionDenied, "denied")
+			}
+			return &testWatchStream{ctx: ctx}, nil
+		},
+	}
+
+	c := newTestClient(ac)
+	c.watchStart = sync.Once{}
+	c.Backoff = time.Millisecond
+	defer close(c.done)
+
+	cert, err := parseCertificate("example.com", selfSigned(t, time.Now().Add(24*time.Hour), "example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	held := 0
+	hold := func(n int) {
+		for i := 0; i < n; i++ {
+			hello := &proto.ClientHelloInfo{Servername: fmt.Sprintf("%d.example.com", held)}
+			c.put(&clientCert{cert: cert, key: proto.CertKey(proto.ProtoToClientHelloInfo(hello)), chi: hello})
+			held++
+		}
+	}
+
+	// expect returns the sizes of the next n streams opened, and checks
+	// that no other stream is opened.
+	expect := func(n int) []int {
+		var sizes []int
+		for i := 0; i < n; i++ {
+			select {
+			case size := <-streams:
+				sizes = append(sizes, size)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("expected %d streams, got %v", n, sizes)
+			}
+		}
+
+		select {
+		case size := <-streams:
+			t.Fatalf("expected %d streams, got another for %d certificates", n, size)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		return sizes
+	}
+
+	// new certificates are watched together, in streams of up to maxWatches.
+	hold(1500)
+	if sizes := expect(2); sizes[0]+sizes[1] != 1500 || sizes[0] > maxWatches || sizes[1] > maxWatches {
+		t.Fatalf("expected 1500 certificates in two streams, got %v", sizes)
+	}
+
+	hold(1)
+	if sizes := expect(2); sizes[0]+sizes[1] != 1501 {
+		t.Fatalf("expected streams to restart with 1501 certificates, got %v", sizes)
+	}
+
+	// refused streams are not retried until the certificates held change.
+	mu.Lock()
+	refuse = true
+	mu.Unlock()
+
+	hold(1)
+	expect(2)
+
+	hold(1)
+	expect(2)
+}
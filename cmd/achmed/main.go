@@ -2,6 +2,7 @@ package main
 
 import (
 	"crypto/ecdsa"
+	cryptotls "crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
 	"flag"
@@ -11,6 +12,7 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"regexp"
 	"strings"
 	"time"
 
@@ -18,6 +20,8 @@ import (
 	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/crypto/openpgp"
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 
@@ -35,18 +39,74 @@ var (
 
 	certdir  = flag.String("cachedir", "", "Directory for certificate cache")
 	etcdaddr = flag.String("etcd", "http://127.0.0.1:2379", "Address of etcd for certificate cache")
+	etcdlock = flag.Bool("etcd-locks", false, "Take turns with other replicas ordering certificates, using locks in etcd")
 
 	// grpc tls configuration
 	tls     = flag.Bool("grpc-tls", false, "Connection uses TLS if true, else plain TCP")
 	tlscert = flag.String("grpc-cert", "", "The TLS cert file")
 	tlskey  = flag.String("grpc-key", "", "The TLS key file")
+	tlsca   = flag.String("grpc-client-ca", "", "CA bundle to require and verify client certificates against")
+	grpcacl = flag.String("grpc-acl", "", "File mapping clients to the host names they may request")
+	admin   = flag.Bool("admin", false, "Serve the Admin service to the admins in -grpc-acl")
 
 	// acme configuration
 	email     = flag.String("acme-email", "", "ACME registration email")
 	directory = flag.String("acme-directory", acme.LetsEncryptURL, "ACME server directory")
 	key       = flag.String("acme-key", "acme.key", "ACME private key")
+
+	// dns-01 configuration
+	dnsServer     = flag.String("dns-rfc2136", "", "Nameserver (host:port) to publish DNS-01 challenges to with RFC 2136 updates")
+	dnsZone       = flag.String("dns-zone", "", "Zone to update, looked up from the nameserver if empty")
+	dnsTSIGKey    = flag.String("dns-tsig-key", "", "TSIG key name signing DNS updates")
+	dnsTSIGSecret = flag.String("dns-tsig-secret", "", "Base64 TSIG secret signing DNS updates")
+	dnsTSIGAlg    = flag.String("dns-tsig-algorithm", "hmac-sha256.", "TSIG algorithm signing DNS updates")
+
+	// issuance limits
+	limitDomain  = flag.Int("limit-domain", server.DefaultLimits.PerDomain, "Certificates per registered domain and week (0 disables)")
+	limitNameSet = flag.Int("limit-nameset", server.DefaultLimits.PerNameSet, "Certificates per exact set of names and week (0 disables)")
+
+	// request rate limits
+	rateClient      = flag.Float64("rate-client", 10, "Requests per second and client (0 disables)")
+	rateClientBurst = flag.Int("rate-client-burst", 20, "Request burst per client")
+	rateName        = flag.Float64("rate-name", 0.01, "Certificate orders per second and server name (0 disables)")
+	rateNameBurst   = flag.Int("rate-name-burst", 5, "Certificate order burst per server name")
+	failureTTL      = flag.Duration("failure-ttl", time.Minute, "How long failures for a server name are returned without asking the ACME server again")
+
+	// background renewal
+	renew         = flag.Bool("renew", false, "Renew cached certificates before they expire, whether they are requested or not")
+	renewBefore   = flag.Duration("renew-before", 30*24*time.Hour, "How long before expiry certificates are renewed")
+	renewJitter   = flag.Duration("renew-jitter", 24*time.Hour, "Spread renewals over up to this much time before -renew-before")
+	renewInterval = flag.Duration("renew-interval", time.Hour, "How often the cache is scanned for certificates to renew")
+
+	// host policy configuration
+	allowHosts    stringList
+	allowSuffixes stringList
+	allowRegexps  stringList
+	wildcards     stringList
+	bundles       stringList
+	etcdhosts     = flag.Bool("etcd-hosts", false, "Allow host names listed in etcd under offblast.org/achmed/hosts/")
 )
 
+func init() {
+	flag.Var(&allowHosts, "allow-host", "Host name to allow certificates for (may be repeated)")
+	flag.Var(&allowSuffixes, "allow-suffix", "Domain to allow certificates for, including all subdomains (may be repeated)")
+	flag.Var(&allowRegexps, "allow-regexp", "Regular expression matching whole host names to allow certificates for (may be repeated)")
+	flag.Var(&bundles, "bundle", "Certificate bundle as name=host,host,... sharing one certificate (may be repeated)")
+	flag.Var(&wildcards, "wildcard", "Domain whose direct subdomains share one wildcard certificate, needs -dns-rfc2136 (may be repeated)")
+}
+
+// stringList is a flag.Value collecting repeated string flags.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
 func checkOptions() {
 	if *address == "" {
 		log.Fatalf("-address is required")
@@ -72,6 +132,18 @@ func checkOptions() {
 		log.Fatalf("-etcd is required with -cache=etcd")
 	}
 
+	if *etcdhosts && *etcdaddr == "" {
+		log.Fatalf("-etcd is required with -etcd-hosts")
+	}
+
+	if *renew && *cachetype == "" {
+		log.Fatalf("-cache=\"\" is invalid with -renew")
+	}
+
+	if *etcdlock && *etcdaddr == "" {
+		log.Fatalf("-etcd is required with -etcd-locks")
+	}
+
 	if *tls {
 		if *tlscert == "" {
 			log.Fatalf("-grpc-cert is required with -grpc-tls")
@@ -81,6 +153,22 @@ func checkOptions() {
 		}
 	}
 
+	if *admin && *grpcacl == "" {
+		log.Fatalf("-grpc-acl is required with -admin")
+	}
+
+	if *tlsca != "" && !*tls {
+		log.Fatalf("-grpc-tls is required with -grpc-client-ca")
+	}
+
+	if len(wildcards) > 0 && *dnsServer == "" {
+		log.Fatalf("-dns-rfc2136 is required with -wildcard")
+	}
+
+	if *dnsTSIGKey != "" && *dnsTSIGSecret == "" {
+		log.Fatalf("-dns-tsig-secret is required with -dns-tsig-key")
+	}
+
 	if *email == "" {
 		log.Fatalf("-acme-email is required")
 	}
@@ -109,6 +197,27 @@ func readKeyring(file string) (openpgp.EntityList, error) {
 	return ent, nil
 }
 
+var etcdClient *clientv3.Client
+
+// getEtcdClient returns the etcd client shared by everything stored in etcd.
+func getEtcdClient() *clientv3.Client {
+	if etcdClient != nil {
+		return etcdClient
+	}
+
+	var err error
+	etcdClient, err = clientv3.New(clientv3.Config{
+		Endpoints:   strings.Split(*etcdaddr, ","),
+		DialTimeout: 5 * time.Second,
+	})
+
+	if err != nil {
+		log.Fatalf("Failed to create etcd client: %v", err)
+	}
+
+	return etcdClient
+}
+
 func getCache() autocert.Cache {
 	var certcache autocert.Cache
 
@@ -118,17 +227,9 @@ func getCache() autocert.Cache {
 	case "memory":
 		certcache = cache.NewMemCache()
 	case "directory":
-		certcache = autocert.DirCache(*certdir)
+		certcache = cache.DirCache(*certdir)
 	case "etcd":
-		etcdClient, err := clientv3.New(clientv3.Config{
-			Endpoints:   strings.Split(*etcdaddr, ","),
-			DialTimeout: 5 * time.Second,
-		})
-
-		if err != nil {
-			log.Fatalf("Failed to create etcd client: %v", err)
-		}
-		certcache = &cache.EtcdCache{etcdClient}
+		certcache = &cache.EtcdCache{getEtcdClient()}
 	default:
 		log.Fatalf("Unknown cache type %q", *cachetype)
 	}
@@ -154,6 +255,43 @@ func getCache() autocert.Cache {
 	return certcache
 }
 
+func getHostPolicy(ctx context.Context) autocert.HostPolicy {
+	var policies []autocert.HostPolicy
+
+	rules := &server.HostRules{
+		Exact:    allowHosts,
+		Suffixes: allowSuffixes,
+	}
+
+	for _, expr := range allowRegexps {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			log.Fatalf("Invalid -allow-regexp %q: %v", expr, err)
+		}
+		rules.Regexps = append(rules.Regexps, re)
+	}
+
+	if !rules.Empty() {
+		policies = append(policies, rules.HostPolicy())
+	}
+
+	if *etcdhosts {
+		hosts := cache.NewEtcdHosts(getEtcdClient())
+		go hosts.Watch(ctx)
+		policies = append(policies, hosts.HostPolicy)
+	}
+
+	switch len(policies) {
+	case 0:
+		log.Printf("No host policy configured, certificates will be requested for any host name")
+		return nil
+	case 1:
+		return policies[0]
+	default:
+		return server.AnyHostPolicy(policies...)
+	}
+}
+
 func main() {
 	flag.Parse()
 
@@ -171,23 +309,94 @@ func main() {
 		DirectoryURL: *directory,
 	}
 
-	achmed, err := server.New(*email, certcache, client, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var serverOpts []server.Option
+	if *grpcacl != "" {
+		auth, err := loadAuthorizer(*grpcacl)
+		if err != nil {
+			log.Fatalf("Can't read client ACL %q: %v", *grpcacl, err)
+		}
+		if *admin && len(auth.Admins) == 0 {
+			log.Fatalf("-admin needs an admin in -grpc-acl %q", *grpcacl)
+		}
+		serverOpts = append(serverOpts, server.WithAuthorizer(auth))
+	}
+
+	if *limitDomain > 0 || *limitNameSet > 0 {
+		serverOpts = append(serverOpts, server.WithLimits(server.Limits{
+			PerDomain:  *limitDomain,
+			PerNameSet: *limitNameSet,
+		}))
+	}
+
+	if *dnsServer != "" {
+		serverOpts = append(serverOpts, server.WithDNSProvider(&server.RFC2136Provider{
+			Nameserver:    *dnsServer,
+			Zone:          *dnsZone,
+			TSIGKey:       *dnsTSIGKey,
+			TSIGSecret:    *dnsTSIGSecret,
+			TSIGAlgorithm: *dnsTSIGAlg,
+		}))
+	}
+
+	if *etcdlock {
+		serverOpts = append(serverOpts, server.WithLocker(&cache.EtcdLocker{Client: getEtcdClient()}))
+	}
+
+	if len(bundles) > 0 {
+		serverOpts = append(serverOpts, server.WithBundles(getBundles()...))
+	}
+
+	if len(wildcards) > 0 {
+		serverOpts = append(serverOpts, server.WithIdentities(server.WildcardIdentities(wildcards...)))
+	}
+
+	if *renew {
+		serverOpts = append(serverOpts, server.WithRenewal(server.Renewal{
+			Before:   *renewBefore,
+			Jitter:   *renewJitter,
+			Interval: *renewInterval,
+		}))
+	}
+
+	serverOpts = append(serverOpts, server.WithRateLimits(server.RateLimits{
+		PerClient:   rate.Limit(*rateClient),
+		ClientBurst: *rateClientBurst,
+		PerName:     rate.Limit(*rateName),
+		NameBurst:   *rateNameBurst,
+		FailureTTL:  *failureTTL,
+	}))
+
+	achmed, err := server.New(*email, certcache, client, getHostPolicy(ctx), serverOpts...)
 	if err != nil {
 		log.Fatalf("Failed to created achemd server: %v", err)
 	}
 
+	if *renew {
+		go func() {
+			if err := achmed.Renew(ctx); err != nil && err != context.Canceled {
+				log.Fatalf("Failed to renew certificates: %v", err)
+			}
+		}()
+	}
+
 	lis, err := net.Listen("tcp", *address)
 	if err != nil {
 		log.Fatalf("Failed to listen: %v", err)
 	}
 
-	var opts []grpc.ServerOption
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(achmed.UnaryInterceptor()),
+		grpc.StreamInterceptor(achmed.StreamInterceptor()),
+	}
 	if *tls {
-		creds, err := credentials.NewServerTLSFromFile(*tlscert, *tlskey)
+		creds, err := getServerCreds()
 		if err != nil {
 			log.Fatalf("Failed to generate credentials %v", err)
 		}
-		opts = []grpc.ServerOption{grpc.Creds(creds)}
+		opts = append(opts, grpc.Creds(creds))
 	}
 
 	grpcServer := grpc.NewServer(opts...)
@@ -196,6 +405,9 @@ func main() {
 	signal.Notify(ch, os.Interrupt)
 
 	achmed.Register(grpcServer)
+	if *admin {
+		achmed.RegisterAdmin(grpcServer)
+	}
 	go func() {
 		if err := grpcServer.Serve(lis); err != nil {
 			log.Printf("Serve ended: %v", err)
@@ -208,6 +420,65 @@ func main() {
 	grpcServer.GracefulStop()
 }
 
+// getServerCreds returns the gRPC server credentials. With -grpc-client-ca,
+// clients must present a certificate signed by one of the CAs in the bundle.
+func getServerCreds() (credentials.TransportCredentials, error) {
+	if *tlsca == "" {
+		return credentials.NewServerTLSFromFile(*tlscert, *tlskey)
+	}
+
+	cert, err := cryptotls.LoadX509KeyPair(*tlscert, *tlskey)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadFile(*tlsca)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in %q", *tlsca)
+	}
+
+	return credentials.NewTLS(&cryptotls.Config{
+		Certificates: []cryptotls.Certificate{cert},
+		ClientAuth:   cryptotls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   cryptotls.VersionTLS12,
+	}), nil
+}
+
+func getBundles() []server.Bundle {
+	var bs []server.Bundle
+
+	for _, b := range bundles {
+		i := strings.Index(b, "=")
+		if i <= 0 || i == len(b)-1 {
+			log.Fatalf("Invalid -bundle %q, want name=host,host,...", b)
+		}
+
+		bs = append(bs, server.Bundle{
+			Name:  b[:i],
+			Names: strings.Split(b[i+1:], ","),
+		})
+	}
+
+	return bs
+}
+
+func loadAuthorizer(file string) (*server.Authorizer, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return server.ParseAuthorizer(f)
+}
+
 func loadKey(file string) (*ecdsa.PrivateKey, error) {
 	f, err := os.Open(file)
 	if err != nil {
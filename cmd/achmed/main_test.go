@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	cryptotls "crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/offblast/achmed"
+	"github.com/offblast/achmed/proto"
+	"github.com/offblast/achmed/server"
+)
+
+// testCA issues the certificates of a test.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns the DER certificate and PKCS#8 key of a new certificate
+// made from tmpl.
+func (ca *testCA) issue(tmpl *x509.Certificate) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return der, pkcs8, nil
+}
+
+// issueFiles writes a new certificate made from tmpl and its key to dir,
+// and returns the file names.
+func (ca *testCA) issueFiles(t *testing.T, dir, name string, tmpl *x509.Certificate) (string, string) {
+	der, pkcs8, err := ca.issue(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+// identityServer hands out certificates for the names the Authorizer
+// allows the caller, and reports the caller's identity.
+type identityServer struct {
+	auth *server.Authorizer
+	ca   *testCA
+	ids  chan string
+}
+
+func (s *identityServer) GetCertificate(ctx context.Context, chi *proto.ClientHelloInfo) (*proto.Certificate, error) {
+	id, err := s.auth.Identity(ctx)
+	if err != nil {
+		return nil, grpc.Errorf(codes.Unauthenticated, "%v", err)
+	}
+	s.ids <- id
+
+	if err := s.auth.Authorize(ctx, chi.Servername); err != nil {
+		return nil, grpc.Errorf(codes.PermissionDenied, "%v", err)
+	}
+
+	der, pkcs8, err := s.ca.issue(&x509.Certificate{DNSNames: []string{chi.Servername}})
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal, "%v", err)
+	}
+
+	return &proto.Certificate{Chain: [][]byte{der}, Privatekey: pkcs8}, nil
+}
+
+func (s *identityServer) GetHTTPChallenge(ctx context.Context, req *proto.HTTPChallengeRequest) (*proto.HTTPChallengeResponse, error) {
+	return nil, grpc.Errorf(codes.Unimplemented, "not implemented")
+}
+
+func (s *identityServer) WatchCertificates(req *proto.WatchRequest, stream proto.Achmed_WatchCertificatesServer) error {
+	return grpc.Errorf(codes.Unimplemented, "not implemented")
+}
+
+func TestClientCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "achmed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	caFile := filepath.Join(dir, "ca.crt")
+	if err := ioutil.WriteFile(caFile, ca.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	*tlscert, *tlskey = ca.issueFiles(t, dir, "server", &x509.Certificate{
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	*tlsca = caFile
+	defer func() { *tlscert, *tlskey, *tlsca = "", "", "" }()
+
+	clientCert, clientKey := ca.issueFiles(t, dir, "client", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "web"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	auth, err := server.ParseAuthorizer(strings.NewReader("client web example.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creds, err := getServerCreds()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &identityServer{auth: auth, ca: ca, ids: make(chan string, 10)}
+	gs := grpc.NewServer(grpc.Creds(creds))
+	proto.RegisterAchmedServer(gs, srv)
+	go gs.Serve(lis)
+	defer gs.Stop()
+
+	c, err := achmed.NewTLS(lis.Addr().String(), clientCert, clientKey, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Timeout = 5 * time.Second
+
+	if _, err := c.GetCertificate(&cryptotls.ClientHelloInfo{ServerName: "example.com"}); err != nil {
+		t.Fatalf("expected certificate for example.com, got %v", err)
+	}
+
+	if id := <-srv.ids; id != "web" {
+		t.Fatalf("expected caller identity from the certificate's common name, got %q", id)
+	}
+
+	if _, err := c.GetCertificate(&cryptotls.ClientHelloInfo{ServerName: "example.org"}); grpc.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected example.org to be denied, got %v", err)
+	}
+	<-srv.ids
+
+	// without a client certificate the handshake fails.
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca.pem)
+
+	anon, err := achmed.New(lis.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(&cryptotls.Config{RootCAs: pool})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer anon.Close()
+	anon.Timeout = 5 * time.Second
+
+	if _, err := anon.GetCertificate(&cryptotls.ClientHelloInfo{ServerName: "example.com"}); grpc.Code(err) != codes.Unavailable {
+		t.Fatalf("expected caller without certificate to be rejected, got %v", err)
+	}
+
+	select {
+	case id := <-srv.ids:
+		t.Fatalf("expected no call without a certificate, got one from %q", id)
+	default:
+	}
+}
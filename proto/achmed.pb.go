@@ -11,6 +11,20 @@ It is generated from these files:
 It has these top-level messages:
 	ClientHelloInfo
 	Certificate
+	HTTPChallengeRequest
+	HTTPChallengeResponse
+	Watch
+	WatchRequest
+	CertificateEvent
+	ListCertificatesRequest
+	CertificateInfo
+	ListCertificatesResponse
+	RevokeCertificateRequest
+	RevokeCertificateResponse
+	RenewCertificateRequest
+	RenewCertificateResponse
+	BudgetRequest
+	BudgetResponse
 */
 package proto
 
@@ -35,10 +49,13 @@ var _ = math.Inf
 const _ = proto1.ProtoPackageIsVersion2 // please upgrade the proto package
 
 type ClientHelloInfo struct {
-	Ciphersuites    []uint32 `protobuf:"varint,1,rep,packed,name=ciphersuites" json:"ciphersuites,omitempty"`
-	Servername      string   `protobuf:"bytes,2,opt,name=servername" json:"servername,omitempty"`
-	Supportedcurves []uint32 `protobuf:"varint,3,rep,packed,name=supportedcurves" json:"supportedcurves,omitempty"`
-	Supportedpoints []byte   `protobuf:"bytes,4,opt,name=supportedpoints,proto3" json:"supportedpoints,omitempty"`
+	Ciphersuites      []uint32 `protobuf:"varint,1,rep,packed,name=ciphersuites" json:"ciphersuites,omitempty"`
+	Servername        string   `protobuf:"bytes,2,opt,name=servername" json:"servername,omitempty"`
+	Supportedcurves   []uint32 `protobuf:"varint,3,rep,packed,name=supportedcurves" json:"supportedcurves,omitempty"`
+	Supportedpoints   []byte   `protobuf:"bytes,4,opt,name=supportedpoints,proto3" json:"supportedpoints,omitempty"`
+	Supportedprotos   []string `protobuf:"bytes,5,rep,name=supportedprotos" json:"supportedprotos,omitempty"`
+	Signatureschemes  []uint32 `protobuf:"varint,6,rep,packed,name=signatureschemes" json:"signatureschemes,omitempty"`
+	Supportedversions []uint32 `protobuf:"varint,7,rep,packed,name=supportedversions" json:"supportedversions,omitempty"`
 }
 
 func (m *ClientHelloInfo) Reset()                    { *m = ClientHelloInfo{} }
@@ -46,9 +63,26 @@ func (m *ClientHelloInfo) String() string            { return proto1.CompactText
 func (*ClientHelloInfo) ProtoMessage()               {}
 func (*ClientHelloInfo) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{0} }
 
-// Certificate is a concatentation of a private key PEM block followed by certificate pem blocks.
+// Certificate is a certificate chain and its private key.
 type Certificate struct {
+	// pem is a concatentation of a private key PEM block followed by certificate pem blocks.
+	// It is kept for older clients, newer clients use the fields below.
 	Pem []byte `protobuf:"bytes,1,opt,name=pem,proto3" json:"pem,omitempty"`
+	// chain is the DER encoded certificate chain, leaf first.
+	Chain [][]byte `protobuf:"bytes,2,rep,name=chain,proto3" json:"chain,omitempty"`
+	// privatekey is the PKCS#8 DER encoded private key of the leaf.
+	Privatekey []byte `protobuf:"bytes,3,opt,name=privatekey,proto3" json:"privatekey,omitempty"`
+	// notbefore and notafter are the validity period of the leaf in seconds since the epoch.
+	Notbefore int64 `protobuf:"varint,4,opt,name=notbefore" json:"notbefore,omitempty"`
+	Notafter  int64 `protobuf:"varint,5,opt,name=notafter" json:"notafter,omitempty"`
+	// issuer is the common name of the leaf's issuer.
+	Issuer string `protobuf:"bytes,6,opt,name=issuer" json:"issuer,omitempty"`
+	// serial is the hex encoded serial number of the leaf.
+	Serial string `protobuf:"bytes,7,opt,name=serial" json:"serial,omitempty"`
+	// ocspstaple is an optional OCSP response for the leaf.
+	Ocspstaple []byte `protobuf:"bytes,8,opt,name=ocspstaple,proto3" json:"ocspstaple,omitempty"`
+	// fingerprint is the hex encoded SHA-256 hash of the leaf, it changes with every renewal.
+	Fingerprint string `protobuf:"bytes,9,opt,name=fingerprint" json:"fingerprint,omitempty"`
 }
 
 func (m *Certificate) Reset()                    { *m = Certificate{} }
@@ -56,9 +90,283 @@ func (m *Certificate) String() string            { return proto1.CompactTextStri
 func (*Certificate) ProtoMessage()               {}
 func (*Certificate) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{1} }
 
+// HTTPChallengeRequest asks for the response to an HTTP-01 challenge
+// request for http://host/.well-known/acme-challenge/token.
+type HTTPChallengeRequest struct {
+	Host  string `protobuf:"bytes,1,opt,name=host" json:"host,omitempty"`
+	Token string `protobuf:"bytes,2,opt,name=token" json:"token,omitempty"`
+}
+
+func (m *HTTPChallengeRequest) Reset()                    { *m = HTTPChallengeRequest{} }
+func (m *HTTPChallengeRequest) String() string            { return proto1.CompactTextString(m) }
+func (*HTTPChallengeRequest) ProtoMessage()               {}
+func (*HTTPChallengeRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
+
+// HTTPChallengeResponse is the key authorization to answer an HTTP-01 challenge with.
+type HTTPChallengeResponse struct {
+	Keyauthorization []byte `protobuf:"bytes,1,opt,name=keyauthorization,proto3" json:"keyauthorization,omitempty"`
+}
+
+func (m *HTTPChallengeResponse) Reset()                    { *m = HTTPChallengeResponse{} }
+func (m *HTTPChallengeResponse) String() string            { return proto1.CompactTextString(m) }
+func (*HTTPChallengeResponse) ProtoMessage()               {}
+func (*HTTPChallengeResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+
+// Watch subscribes to the certificate GetCertificate returns for hello.
+type Watch struct {
+	Hello *ClientHelloInfo `protobuf:"bytes,1,opt,name=hello" json:"hello,omitempty"`
+	// fingerprint is the fingerprint of the certificate the client holds,
+	// empty if none. A different certificate is sent right away.
+	Fingerprint string `protobuf:"bytes,2,opt,name=fingerprint" json:"fingerprint,omitempty"`
+}
+
+func (m *Watch) Reset()                    { *m = Watch{} }
+func (m *Watch) String() string            { return proto1.CompactTextString(m) }
+func (*Watch) ProtoMessage()               {}
+func (*Watch) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
+
+func (m *Watch) GetHello() *ClientHelloInfo {
+	if m != nil {
+		return m.Hello
+	}
+	return nil
+}
+
+type WatchRequest struct {
+	Watches []*Watch `protobuf:"bytes,1,rep,name=watches" json:"watches,omitempty"`
+}
+
+func (m *WatchRequest) Reset()                    { *m = WatchRequest{} }
+func (m *WatchRequest) String() string            { return proto1.CompactTextString(m) }
+func (*WatchRequest) ProtoMessage()               {}
+func (*WatchRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{5} }
+
+func (m *WatchRequest) GetWatches() []*Watch {
+	if m != nil {
+		return m.Watches
+	}
+	return nil
+}
+
+// CertificateEvent tells a watcher that the certificate for a watched hello changed.
+type CertificateEvent struct {
+	// hello is the hello of the watch the event is for.
+	Hello *ClientHelloInfo `protobuf:"bytes,1,opt,name=hello" json:"hello,omitempty"`
+	// certificate is the new certificate, unset if it was revoked.
+	Certificate *Certificate `protobuf:"bytes,2,opt,name=certificate" json:"certificate,omitempty"`
+	// revoked is set if the certificate was revoked, GetCertificate returns a new one.
+	Revoked bool `protobuf:"varint,3,opt,name=revoked" json:"revoked,omitempty"`
+}
+
+func (m *CertificateEvent) Reset()                    { *m = CertificateEvent{} }
+func (m *CertificateEvent) String() string            { return proto1.CompactTextString(m) }
+func (*CertificateEvent) ProtoMessage()               {}
+func (*CertificateEvent) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{6} }
+
+func (m *CertificateEvent) GetHello() *ClientHelloInfo {
+	if m != nil {
+		return m.Hello
+	}
+	return nil
+}
+
+func (m *CertificateEvent) GetCertificate() *Certificate {
+	if m != nil {
+		return m.Certificate
+	}
+	return nil
+}
+
+// ListCertificatesRequest asks for a page of the certificates in the cache.
+type ListCertificatesRequest struct {
+	// name, if set, only lists certificates for this DNS name, or with a
+	// leading ".", for the domain and all its subdomains.
+	Name string `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
+	// expiringwithin, if set, only lists certificates expiring within this many seconds.
+	Expiringwithin int64 `protobuf:"varint,2,opt,name=expiringwithin" json:"expiringwithin,omitempty"`
+	// pagesize is the maximum number of certificates returned, 100 if zero.
+	Pagesize int32 `protobuf:"varint,3,opt,name=pagesize" json:"pagesize,omitempty"`
+	// pagetoken is the nextpagetoken of the previous page, empty for the first page.
+	Pagetoken string `protobuf:"bytes,4,opt,name=pagetoken" json:"pagetoken,omitempty"`
+}
+
+func (m *ListCertificatesRequest) Reset()                    { *m = ListCertificatesRequest{} }
+func (m *ListCertificatesRequest) String() string            { return proto1.CompactTextString(m) }
+func (*ListCertificatesRequest) ProtoMessage()               {}
+func (*ListCertificatesRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{7} }
+
+// CertificateInfo describes a certificate in the cache.
+type CertificateInfo struct {
+	// key is the cache key of the certificate, e.g. "example.com+rsa".
+	Key string `protobuf:"bytes,1,opt,name=key" json:"key,omitempty"`
+	// name is the common name of the leaf, dnsnames its subject alternative names.
+	Name     string   `protobuf:"bytes,2,opt,name=name" json:"name,omitempty"`
+	Dnsnames []string `protobuf:"bytes,3,rep,name=dnsnames" json:"dnsnames,omitempty"`
+	// issuer is the common name of the leaf's issuer.
+	Issuer string `protobuf:"bytes,4,opt,name=issuer" json:"issuer,omitempty"`
+	// serial is the hex encoded serial number of the leaf.
+	Serial string `protobuf:"bytes,5,opt,name=serial" json:"serial,omitempty"`
+	// notbefore and notafter are the validity period of the leaf in seconds since the epoch.
+	Notbefore int64 `protobuf:"varint,6,opt,name=notbefore" json:"notbefore,omitempty"`
+	Notafter  int64 `protobuf:"varint,7,opt,name=notafter" json:"notafter,omitempty"`
+	// keytype is the type and size of the leaf's key, e.g. "ECDSA P-256" or "RSA 2048".
+	Keytype string `protobuf:"bytes,8,opt,name=keytype" json:"keytype,omitempty"`
+	// lastrenewal is when renewing the certificate was last attempted in
+	// seconds since the epoch, zero if never, and lastrenewalerror why
+	// that attempt failed, empty if it succeeded.
+	Lastrenewal      int64  `protobuf:"varint,9,opt,name=lastrenewal" json:"lastrenewal,omitempty"`
+	Lastrenewalerror string `protobuf:"bytes,10,opt,name=lastrenewalerror" json:"lastrenewalerror,omitempty"`
+}
+
+func (m *CertificateInfo) Reset()                    { *m = CertificateInfo{} }
+func (m *CertificateInfo) String() string            { return proto1.CompactTextString(m) }
+func (*CertificateInfo) ProtoMessage()               {}
+func (*CertificateInfo) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{8} }
+
+type ListCertificatesResponse struct {
+	Certificates []*CertificateInfo `protobuf:"bytes,1,rep,name=certificates" json:"certificates,omitempty"`
+	// nextpagetoken fetches the next page, empty on the last page.
+	Nextpagetoken string `protobuf:"bytes,2,opt,name=nextpagetoken" json:"nextpagetoken,omitempty"`
+}
+
+func (m *ListCertificatesResponse) Reset()                    { *m = ListCertificatesResponse{} }
+func (m *ListCertificatesResponse) String() string            { return proto1.CompactTextString(m) }
+func (*ListCertificatesResponse) ProtoMessage()               {}
+func (*ListCertificatesResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{9} }
+
+func (m *ListCertificatesResponse) GetCertificates() []*CertificateInfo {
+	if m != nil {
+		return m.Certificates
+	}
+	return nil
+}
+
+// RevokeCertificateRequest asks to revoke a certificate in the cache.
+type RevokeCertificateRequest struct {
+	// key is the cache key of the certificate, as listed by ListCertificates.
+	Key string `protobuf:"bytes,1,opt,name=key" json:"key,omitempty"`
+	// reason is the RFC 5280 CRL reason code, e.g. 1 for a compromised key.
+	Reason int32 `protobuf:"varint,2,opt,name=reason" json:"reason,omitempty"`
+	// reissue issues a new certificate for the same names right away.
+	Reissue bool `protobuf:"varint,3,opt,name=reissue" json:"reissue,omitempty"`
+}
+
+func (m *RevokeCertificateRequest) Reset()                    { *m = RevokeCertificateRequest{} }
+func (m *RevokeCertificateRequest) String() string            { return proto1.CompactTextString(m) }
+func (*RevokeCertificateRequest) ProtoMessage()               {}
+func (*RevokeCertificateRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{10} }
+
+type RevokeCertificateResponse struct {
+	// revoked is the certificate that was revoked.
+	Revoked *CertificateInfo `protobuf:"bytes,1,opt,name=revoked" json:"revoked,omitempty"`
+	// reissued is the new certificate, if one was requested.
+	Reissued *CertificateInfo `protobuf:"bytes,2,opt,name=reissued" json:"reissued,omitempty"`
+}
+
+func (m *RevokeCertificateResponse) Reset()                    { *m = RevokeCertificateResponse{} }
+func (m *RevokeCertificateResponse) String() string            { return proto1.CompactTextString(m) }
+func (*RevokeCertificateResponse) ProtoMessage()               {}
+func (*RevokeCertificateResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{11} }
+
+func (m *RevokeCertificateResponse) GetRevoked() *CertificateInfo {
+	if m != nil {
+		return m.Revoked
+	}
+	return nil
+}
+
+func (m *RevokeCertificateResponse) GetReissued() *CertificateInfo {
+	if m != nil {
+		return m.Reissued
+	}
+	return nil
+}
+
+// RenewCertificateRequest asks to order a new certificate right away.
+type RenewCertificateRequest struct {
+	// name is a server name or the name of a bundle.
+	Name string `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
+	// rsa renews the RSA certificate instead of the ECDSA one.
+	Rsa bool `protobuf:"varint,2,opt,name=rsa" json:"rsa,omitempty"`
+}
+
+func (m *RenewCertificateRequest) Reset()                    { *m = RenewCertificateRequest{} }
+func (m *RenewCertificateRequest) String() string            { return proto1.CompactTextString(m) }
+func (*RenewCertificateRequest) ProtoMessage()               {}
+func (*RenewCertificateRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{12} }
+
+type RenewCertificateResponse struct {
+	// certificate is the new certificate.
+	Certificate *CertificateInfo `protobuf:"bytes,1,opt,name=certificate" json:"certificate,omitempty"`
+	// previous is the certificate it replaced, if there was one.
+	Previous *CertificateInfo `protobuf:"bytes,2,opt,name=previous" json:"previous,omitempty"`
+}
+
+func (m *RenewCertificateResponse) Reset()                    { *m = RenewCertificateResponse{} }
+func (m *RenewCertificateResponse) String() string            { return proto1.CompactTextString(m) }
+func (*RenewCertificateResponse) ProtoMessage()               {}
+func (*RenewCertificateResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{13} }
+
+func (m *RenewCertificateResponse) GetCertificate() *CertificateInfo {
+	if m != nil {
+		return m.Certificate
+	}
+	return nil
+}
+
+func (m *RenewCertificateResponse) GetPrevious() *CertificateInfo {
+	if m != nil {
+		return m.Previous
+	}
+	return nil
+}
+
+// BudgetRequest asks for the remaining weekly issuance budget of the
+// registered domain of name.
+type BudgetRequest struct {
+	Name string `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
+}
+
+func (m *BudgetRequest) Reset()                    { *m = BudgetRequest{} }
+func (m *BudgetRequest) String() string            { return proto1.CompactTextString(m) }
+func (*BudgetRequest) ProtoMessage()               {}
+func (*BudgetRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{14} }
+
+type BudgetResponse struct {
+	// domain is the registered domain the budget is counted for.
+	Domain string `protobuf:"bytes,1,opt,name=domain" json:"domain,omitempty"`
+	// limit is the weekly limit of certificates for the domain, zero if there is none.
+	Limit int32 `protobuf:"varint,2,opt,name=limit" json:"limit,omitempty"`
+	// used is the number of certificates issued this week, remaining how many more may be.
+	Used      int32 `protobuf:"varint,3,opt,name=used" json:"used,omitempty"`
+	Remaining int32 `protobuf:"varint,4,opt,name=remaining" json:"remaining,omitempty"`
+	// resetat is when the oldest counted issuance leaves the window in
+	// seconds since the epoch, zero if nothing was issued this week.
+	Resetat int64 `protobuf:"varint,5,opt,name=resetat" json:"resetat,omitempty"`
+}
+
+func (m *BudgetResponse) Reset()                    { *m = BudgetResponse{} }
+func (m *BudgetResponse) String() string            { return proto1.CompactTextString(m) }
+func (*BudgetResponse) ProtoMessage()               {}
+func (*BudgetResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{15} }
+
 func init() {
 	proto1.RegisterType((*ClientHelloInfo)(nil), "proto.ClientHelloInfo")
 	proto1.RegisterType((*Certificate)(nil), "proto.Certificate")
+	proto1.RegisterType((*HTTPChallengeRequest)(nil), "proto.HTTPChallengeRequest")
+	proto1.RegisterType((*HTTPChallengeResponse)(nil), "proto.HTTPChallengeResponse")
+	proto1.RegisterType((*Watch)(nil), "proto.Watch")
+	proto1.RegisterType((*WatchRequest)(nil), "proto.WatchRequest")
+	proto1.RegisterType((*CertificateEvent)(nil), "proto.CertificateEvent")
+	proto1.RegisterType((*ListCertificatesRequest)(nil), "proto.ListCertificatesRequest")
+	proto1.RegisterType((*CertificateInfo)(nil), "proto.CertificateInfo")
+	proto1.RegisterType((*ListCertificatesResponse)(nil), "proto.ListCertificatesResponse")
+	proto1.RegisterType((*RevokeCertificateRequest)(nil), "proto.RevokeCertificateRequest")
+	proto1.RegisterType((*RevokeCertificateResponse)(nil), "proto.RevokeCertificateResponse")
+	proto1.RegisterType((*RenewCertificateRequest)(nil), "proto.RenewCertificateRequest")
+	proto1.RegisterType((*RenewCertificateResponse)(nil), "proto.RenewCertificateResponse")
+	proto1.RegisterType((*BudgetRequest)(nil), "proto.BudgetRequest")
+	proto1.RegisterType((*BudgetResponse)(nil), "proto.BudgetResponse")
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -73,6 +381,8 @@ const _ = grpc.SupportPackageIsVersion3
 
 type AchmedClient interface {
 	GetCertificate(ctx context.Context, in *ClientHelloInfo, opts ...grpc.CallOption) (*Certificate, error)
+	GetHTTPChallenge(ctx context.Context, in *HTTPChallengeRequest, opts ...grpc.CallOption) (*HTTPChallengeResponse, error)
+	WatchCertificates(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Achmed_WatchCertificatesClient, error)
 }
 
 type achmedClient struct {
@@ -92,10 +402,53 @@ func (c *achmedClient) GetCertificate(ctx context.Context, in *ClientHelloInfo,
 	return out, nil
 }
 
+func (c *achmedClient) GetHTTPChallenge(ctx context.Context, in *HTTPChallengeRequest, opts ...grpc.CallOption) (*HTTPChallengeResponse, error) {
+	out := new(HTTPChallengeResponse)
+	err := grpc.Invoke(ctx, "/proto.Achmed/GetHTTPChallenge", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *achmedClient) WatchCertificates(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Achmed_WatchCertificatesClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_Achmed_serviceDesc.Streams[0], c.cc, "/proto.Achmed/WatchCertificates", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &achmedWatchCertificatesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Achmed_WatchCertificatesClient interface {
+	Recv() (*CertificateEvent, error)
+	grpc.ClientStream
+}
+
+type achmedWatchCertificatesClient struct {
+	grpc.ClientStream
+}
+
+func (x *achmedWatchCertificatesClient) Recv() (*CertificateEvent, error) {
+	m := new(CertificateEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // Server API for Achmed service
 
 type AchmedServer interface {
 	GetCertificate(context.Context, *ClientHelloInfo) (*Certificate, error)
+	GetHTTPChallenge(context.Context, *HTTPChallengeRequest) (*HTTPChallengeResponse, error)
+	WatchCertificates(*WatchRequest, Achmed_WatchCertificatesServer) error
 }
 
 func RegisterAchmedServer(s *grpc.Server, srv AchmedServer) {
@@ -120,6 +473,45 @@ func _Achmed_GetCertificate_Handler(srv interface{}, ctx context.Context, dec fu
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Achmed_GetHTTPChallenge_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HTTPChallengeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AchmedServer).GetHTTPChallenge(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.Achmed/GetHTTPChallenge",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AchmedServer).GetHTTPChallenge(ctx, req.(*HTTPChallengeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Achmed_WatchCertificates_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AchmedServer).WatchCertificates(m, &achmedWatchCertificatesServer{stream})
+}
+
+type Achmed_WatchCertificatesServer interface {
+	Send(*CertificateEvent) error
+	grpc.ServerStream
+}
+
+type achmedWatchCertificatesServer struct {
+	grpc.ServerStream
+}
+
+func (x *achmedWatchCertificatesServer) Send(m *CertificateEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 var _Achmed_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "proto.Achmed",
 	HandlerType: (*AchmedServer)(nil),
@@ -128,6 +520,179 @@ var _Achmed_serviceDesc = grpc.ServiceDesc{
 			MethodName: "GetCertificate",
 			Handler:    _Achmed_GetCertificate_Handler,
 		},
+		{
+			MethodName: "GetHTTPChallenge",
+			Handler:    _Achmed_GetHTTPChallenge_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchCertificates",
+			Handler:       _Achmed_WatchCertificates_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: fileDescriptor0,
+}
+
+// Client API for Admin service
+
+type AdminClient interface {
+	ListCertificates(ctx context.Context, in *ListCertificatesRequest, opts ...grpc.CallOption) (*ListCertificatesResponse, error)
+	RevokeCertificate(ctx context.Context, in *RevokeCertificateRequest, opts ...grpc.CallOption) (*RevokeCertificateResponse, error)
+	RenewCertificate(ctx context.Context, in *RenewCertificateRequest, opts ...grpc.CallOption) (*RenewCertificateResponse, error)
+	GetBudget(ctx context.Context, in *BudgetRequest, opts ...grpc.CallOption) (*BudgetResponse, error)
+}
+
+type adminClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewAdminClient(cc *grpc.ClientConn) AdminClient {
+	return &adminClient{cc}
+}
+
+func (c *adminClient) ListCertificates(ctx context.Context, in *ListCertificatesRequest, opts ...grpc.CallOption) (*ListCertificatesResponse, error) {
+	out := new(ListCertificatesResponse)
+	err := grpc.Invoke(ctx, "/proto.Admin/ListCertificates", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) RevokeCertificate(ctx context.Context, in *RevokeCertificateRequest, opts ...grpc.CallOption) (*RevokeCertificateResponse, error) {
+	out := new(RevokeCertificateResponse)
+	err := grpc.Invoke(ctx, "/proto.Admin/RevokeCertificate", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) RenewCertificate(ctx context.Context, in *RenewCertificateRequest, opts ...grpc.CallOption) (*RenewCertificateResponse, error) {
+	out := new(RenewCertificateResponse)
+	err := grpc.Invoke(ctx, "/proto.Admin/RenewCertificate", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) GetBudget(ctx context.Context, in *BudgetRequest, opts ...grpc.CallOption) (*BudgetResponse, error) {
+	out := new(BudgetResponse)
+	err := grpc.Invoke(ctx, "/proto.Admin/GetBudget", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Server API for Admin service
+
+type AdminServer interface {
+	ListCertificates(context.Context, *ListCertificatesRequest) (*ListCertificatesResponse, error)
+	RevokeCertificate(context.Context, *RevokeCertificateRequest) (*RevokeCertificateResponse, error)
+	RenewCertificate(context.Context, *RenewCertificateRequest) (*RenewCertificateResponse, error)
+	GetBudget(context.Context, *BudgetRequest) (*BudgetResponse, error)
+}
+
+func RegisterAdminServer(s *grpc.Server, srv AdminServer) {
+	s.RegisterService(&_Admin_serviceDesc, srv)
+}
+
+func _Admin_ListCertificates_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListCertificatesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).ListCertificates(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.Admin/ListCertificates",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).ListCertificates(ctx, req.(*ListCertificatesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_RevokeCertificate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RevokeCertificateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).RevokeCertificate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.Admin/RevokeCertificate",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).RevokeCertificate(ctx, req.(*RevokeCertificateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_RenewCertificate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RenewCertificateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).RenewCertificate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.Admin/RenewCertificate",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).RenewCertificate(ctx, req.(*RenewCertificateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_GetBudget_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BudgetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).GetBudget(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.Admin/GetBudget",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).GetBudget(ctx, req.(*BudgetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _Admin_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "proto.Admin",
+	HandlerType: (*AdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListCertificates",
+			Handler:    _Admin_ListCertificates_Handler,
+		},
+		{
+			MethodName: "RevokeCertificate",
+			Handler:    _Admin_RevokeCertificate_Handler,
+		},
+		{
+			MethodName: "RenewCertificate",
+			Handler:    _Admin_RenewCertificate_Handler,
+		},
+		{
+			MethodName: "GetBudget",
+			Handler:    _Admin_GetBudget_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: fileDescriptor0,
@@ -136,18 +701,71 @@ var _Achmed_serviceDesc = grpc.ServiceDesc{
 func init() { proto1.RegisterFile("achmed.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 208 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x5c, 0xcf, 0xb1, 0x4a, 0xc7, 0x30,
-	0x10, 0xc7, 0x71, 0x63, 0xf5, 0x0f, 0x9e, 0xd5, 0x4a, 0x06, 0x09, 0x0e, 0x5a, 0x32, 0x65, 0xea,
-	0xa0, 0xbb, 0x20, 0x1d, 0xac, 0x6b, 0xdf, 0xa0, 0xa6, 0x57, 0x1a, 0x68, 0x93, 0x90, 0x5c, 0xfb,
-	0x4e, 0xbe, 0xa5, 0x18, 0x11, 0xdb, 0x4e, 0x09, 0x1f, 0xbe, 0x1c, 0xfc, 0x20, 0xef, 0xf4, 0x38,
-	0x63, 0x5f, 0xf9, 0xe0, 0xc8, 0xf1, 0xcb, 0xf4, 0xc8, 0x2f, 0x06, 0x45, 0x3d, 0x19, 0xb4, 0xd4,
-	0xe0, 0x34, 0xb9, 0x0f, 0x3b, 0x38, 0x2e, 0x21, 0xd7, 0xc6, 0x8f, 0x18, 0xe2, 0x62, 0x08, 0xa3,
-	0x60, 0x65, 0xa6, 0x6e, 0xda, 0x9d, 0xf1, 0x47, 0x80, 0x88, 0x61, 0xc5, 0x60, 0xbb, 0x19, 0xc5,
-	0x79, 0xc9, 0xd4, 0x55, 0xbb, 0x11, 0xae, 0xa0, 0x88, 0x8b, 0xf7, 0x2e, 0x10, 0xf6, 0x7a, 0x09,
-	0x2b, 0x46, 0x91, 0xa5, 0x33, 0x47, 0xde, 0x95, 0xde, 0x19, 0x4b, 0x51, 0x5c, 0x94, 0x4c, 0xe5,
-	0xed, 0x91, 0xe5, 0x13, 0x5c, 0xd7, 0x18, 0xc8, 0x0c, 0x46, 0x77, 0x84, 0xfc, 0x0e, 0x32, 0x8f,
-	0xb3, 0x60, 0x29, 0xfe, 0xf9, 0x3e, 0x37, 0x70, 0x7a, 0x4b, 0x1b, 0xf9, 0x2b, 0xdc, 0xbe, 0x23,
-	0x6d, 0xeb, 0xfb, 0xdf, 0xdd, 0xd5, 0x61, 0xec, 0x03, 0xff, 0xf3, 0xff, 0x56, 0x9e, 0x7d, 0x9e,
-	0x12, 0xbe, 0x7c, 0x07, 0x00, 0x00, 0xff, 0xff, 0x29, 0x56, 0x07, 0xd2, 0x34, 0x01, 0x00, 0x00,
+	// 1041 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x94, 0x56, 0x4d, 0x8f, 0x1b, 0x45,
+	0x13, 0xce, 0x78, 0x76, 0xfc, 0x51, 0x76, 0x36, 0xde, 0x7e, 0x37, 0xbb, 0xfd, 0x9a, 0x28, 0xb1,
+	0x06, 0x14, 0x59, 0x28, 0x8a, 0x22, 0x83, 0x10, 0xca, 0x01, 0x08, 0xab, 0x68, 0x83, 0x84, 0x04,
+	0x6a, 0x25, 0x0a, 0x27, 0xa4, 0x89, 0x5d, 0x6b, 0xb7, 0xd6, 0xee, 0x19, 0xba, 0xdb, 0xde, 0x6c,
+	0xc4, 0x25, 0x37, 0xc4, 0x05, 0xfe, 0x04, 0x47, 0x7e, 0x09, 0x7f, 0x82, 0x9f, 0x82, 0xfa, 0x63,
+	0xec, 0xf9, 0xb0, 0x17, 0x71, 0x72, 0xd7, 0xd3, 0xd5, 0x35, 0x55, 0x5d, 0xcf, 0x53, 0x6d, 0xe8,
+	0x25, 0x93, 0xf9, 0x12, 0xa7, 0x8f, 0x33, 0x99, 0xea, 0x94, 0x44, 0xf6, 0x27, 0xfe, 0xb3, 0x01,
+	0x77, 0xce, 0x16, 0x1c, 0x85, 0x7e, 0x81, 0x8b, 0x45, 0xfa, 0x8d, 0xb8, 0x48, 0x49, 0x0c, 0xbd,
+	0x09, 0xcf, 0xe6, 0x28, 0xd5, 0x8a, 0x6b, 0x54, 0x34, 0x18, 0x86, 0xa3, 0xdb, 0xac, 0x84, 0x91,
+	0xfb, 0x00, 0x0a, 0xe5, 0x1a, 0xa5, 0x48, 0x96, 0x48, 0x1b, 0xc3, 0x60, 0xd4, 0x61, 0x05, 0x84,
+	0x8c, 0xe0, 0x8e, 0x5a, 0x65, 0x59, 0x2a, 0x35, 0x4e, 0x27, 0x2b, 0xb9, 0x46, 0x45, 0x43, 0x1b,
+	0xa6, 0x0a, 0x97, 0x3c, 0xb3, 0x94, 0x0b, 0xad, 0xe8, 0xc1, 0x30, 0x18, 0xf5, 0x58, 0x15, 0x2e,
+	0x7b, 0x9a, 0xec, 0x15, 0x8d, 0x86, 0xe1, 0xa8, 0xc3, 0xaa, 0x30, 0xf9, 0x18, 0xfa, 0x8a, 0xcf,
+	0x44, 0xa2, 0x57, 0x12, 0xd5, 0x64, 0x8e, 0x4b, 0x54, 0xb4, 0x69, 0x3f, 0x5f, 0xc3, 0xc9, 0x23,
+	0x38, 0xda, 0x1c, 0x5f, 0xa3, 0x54, 0x3c, 0x15, 0x8a, 0xb6, 0xac, 0x73, 0x7d, 0x23, 0x7e, 0xdf,
+	0x80, 0xee, 0x19, 0x4a, 0xcd, 0x2f, 0xf8, 0x24, 0xd1, 0x48, 0xfa, 0x10, 0x66, 0xb8, 0xa4, 0x81,
+	0xcd, 0xd8, 0x2c, 0xc9, 0x31, 0x44, 0x93, 0x79, 0xc2, 0x05, 0x6d, 0x0c, 0xc3, 0x51, 0x8f, 0x39,
+	0xc3, 0xdc, 0x57, 0x26, 0xf9, 0x3a, 0xd1, 0x78, 0x89, 0xd7, 0x34, 0xb4, 0xee, 0x05, 0x84, 0xdc,
+	0x83, 0x8e, 0x48, 0xf5, 0x1b, 0xbc, 0x48, 0x25, 0xda, 0xfa, 0x43, 0xb6, 0x05, 0xc8, 0x00, 0xda,
+	0x22, 0xd5, 0xc9, 0x85, 0x46, 0x49, 0x23, 0xbb, 0xb9, 0xb1, 0xc9, 0x09, 0x34, 0xb9, 0x52, 0x2b,
+	0x94, 0xb4, 0x69, 0xbb, 0xe0, 0x2d, 0x83, 0x2b, 0x94, 0x3c, 0x59, 0xd0, 0x96, 0xc3, 0x9d, 0x65,
+	0x32, 0x49, 0x27, 0x2a, 0x53, 0x3a, 0xc9, 0x16, 0x48, 0xdb, 0x2e, 0x93, 0x2d, 0x42, 0x86, 0xd0,
+	0xbd, 0xe0, 0x62, 0x86, 0x32, 0x93, 0x5c, 0x68, 0xda, 0xb1, 0x87, 0x8b, 0x50, 0xfc, 0x15, 0x1c,
+	0xbf, 0x78, 0xf9, 0xf2, 0xfb, 0xb3, 0x79, 0xb2, 0x58, 0xa0, 0x98, 0x21, 0xc3, 0x9f, 0x56, 0xa8,
+	0x34, 0x21, 0x70, 0x30, 0x4f, 0x95, 0xb6, 0x97, 0xd1, 0x61, 0x76, 0x6d, 0x6e, 0x43, 0xa7, 0x97,
+	0x28, 0x3c, 0x45, 0x9c, 0x11, 0x9f, 0xc1, 0xdd, 0x4a, 0x04, 0x95, 0xa5, 0x42, 0xa1, 0x69, 0xdc,
+	0x25, 0x5e, 0x27, 0x2b, 0x3d, 0x4f, 0x25, 0x7f, 0x97, 0x68, 0x9e, 0x0a, 0x7f, 0xb7, 0x35, 0x3c,
+	0x7e, 0x0d, 0xd1, 0xeb, 0x44, 0x4f, 0xe6, 0xe4, 0x11, 0x44, 0x73, 0x43, 0x5e, 0xeb, 0xd9, 0x1d,
+	0x9f, 0x38, 0x86, 0x3f, 0xae, 0xd0, 0x9a, 0x39, 0xa7, 0x6a, 0x7d, 0x8d, 0x7a, 0x7d, 0x9f, 0x41,
+	0xcf, 0x06, 0xce, 0xeb, 0x7a, 0x08, 0xad, 0x2b, 0x63, 0x7b, 0x29, 0x74, 0xc7, 0x3d, 0xff, 0x05,
+	0xe7, 0x95, 0x6f, 0xc6, 0xbf, 0x07, 0xd0, 0x2f, 0x70, 0xe3, 0xf9, 0x1a, 0x85, 0xfe, 0x8f, 0xc9,
+	0x7d, 0x0a, 0xdd, 0xc9, 0x36, 0x82, 0x4d, 0xae, 0x3b, 0x26, 0xf9, 0x99, 0xed, 0x0e, 0x2b, 0xba,
+	0x11, 0x0a, 0x2d, 0x89, 0xeb, 0xf4, 0x12, 0xa7, 0x96, 0x59, 0x6d, 0x96, 0x9b, 0xf1, 0x6f, 0x01,
+	0x9c, 0x7e, 0xcb, 0x95, 0x2e, 0x1c, 0x55, 0x85, 0x76, 0x59, 0xf1, 0xfa, 0x76, 0x99, 0x35, 0x79,
+	0x08, 0x87, 0xf8, 0x36, 0xe3, 0x92, 0x8b, 0xd9, 0x15, 0xd7, 0x73, 0xee, 0xfa, 0x16, 0xb2, 0x0a,
+	0x6a, 0x08, 0x99, 0x25, 0x33, 0x54, 0xfc, 0x1d, 0xda, 0x4f, 0x46, 0x6c, 0x63, 0x1b, 0x2a, 0x9b,
+	0xb5, 0x6b, 0xfb, 0x81, 0x0d, 0xbe, 0x05, 0xe2, 0x3f, 0xcc, 0xc0, 0xd9, 0x66, 0x63, 0x07, 0x4e,
+	0x1f, 0x42, 0xa3, 0x0a, 0x97, 0x88, 0x59, 0x6e, 0x72, 0x6b, 0x14, 0x72, 0x1b, 0x40, 0x7b, 0x2a,
+	0x94, 0x59, 0xba, 0x59, 0xd2, 0x61, 0x1b, 0xbb, 0x20, 0x82, 0x83, 0x3d, 0x22, 0x88, 0x4a, 0x22,
+	0x28, 0xc9, 0xad, 0x79, 0x93, 0xdc, 0x5a, 0x15, 0xb9, 0x51, 0x68, 0x5d, 0xe2, 0xb5, 0xbe, 0xce,
+	0x9c, 0x76, 0x3a, 0x2c, 0x37, 0x0d, 0xb1, 0x16, 0x89, 0xd2, 0x12, 0x05, 0x5e, 0x25, 0x0b, 0x2b,
+	0x9c, 0x90, 0x15, 0x21, 0xc3, 0xee, 0x82, 0x89, 0x52, 0xa6, 0x92, 0x82, 0x0d, 0x52, 0xc3, 0xe3,
+	0x9f, 0x81, 0xd6, 0x1b, 0xe7, 0x55, 0xf2, 0x14, 0x7a, 0x85, 0xf6, 0xe7, 0xac, 0x3c, 0xa9, 0xd3,
+	0xc4, 0x52, 0xab, 0xe4, 0x4b, 0x3e, 0x82, 0xdb, 0x02, 0xdf, 0xea, 0x6d, 0x87, 0xdc, 0x15, 0x97,
+	0xc1, 0xf8, 0x47, 0xa0, 0xcc, 0x52, 0xa8, 0xc8, 0x39, 0xcf, 0x9b, 0x7a, 0xb7, 0x4e, 0xa0, 0x29,
+	0x31, 0x51, 0xa9, 0x0b, 0x16, 0x31, 0x6f, 0x39, 0x5e, 0xda, 0x4e, 0x6c, 0x79, 0x69, 0xcd, 0xf8,
+	0x7d, 0x00, 0xff, 0xdf, 0xf1, 0x01, 0x5f, 0xdf, 0x93, 0x2d, 0x9f, 0x2b, 0xaa, 0xa9, 0x94, 0x96,
+	0xbb, 0x91, 0x31, 0xb4, 0x7d, 0xe8, 0x29, 0x6d, 0xdc, 0x78, 0x64, 0xe3, 0x17, 0x7f, 0x09, 0xa7,
+	0xcc, 0xdc, 0xf8, 0x8e, 0x12, 0x77, 0x49, 0xa3, 0x0f, 0xa1, 0x54, 0x89, 0x8d, 0xde, 0x66, 0x66,
+	0x19, 0xff, 0x12, 0x00, 0xad, 0x47, 0xf0, 0x35, 0x7c, 0x5e, 0x56, 0xf2, 0xcd, 0x75, 0x94, 0xd4,
+	0x3c, 0x86, 0x76, 0x26, 0x71, 0xcd, 0xd3, 0x95, 0xfa, 0xb7, 0x5a, 0x72, 0xbf, 0xf8, 0x43, 0xb8,
+	0xfd, 0xf5, 0x6a, 0x3a, 0x43, 0x7d, 0x43, 0x05, 0xf1, 0xaf, 0x01, 0x1c, 0xe6, 0x5e, 0x3e, 0xcb,
+	0x13, 0x68, 0x4e, 0xd3, 0xa5, 0x79, 0xad, 0x9c, 0xa3, 0xb7, 0xcc, 0xd8, 0x5e, 0xf0, 0x25, 0xd7,
+	0xbe, 0xa1, 0xce, 0x30, 0x41, 0x57, 0xca, 0x0f, 0x99, 0x88, 0xd9, 0xb5, 0x51, 0x92, 0x44, 0x73,
+	0x86, 0x8b, 0x99, 0x15, 0x5f, 0xc4, 0xb6, 0x80, 0x63, 0x80, 0x42, 0x9d, 0x68, 0xff, 0x6e, 0xe5,
+	0xe6, 0xf8, 0xef, 0x00, 0x9a, 0xcf, 0xec, 0x1f, 0x12, 0xf2, 0x05, 0x1c, 0x9e, 0x63, 0x91, 0xe9,
+	0x64, 0xcf, 0x94, 0x1c, 0xec, 0x98, 0x84, 0xf1, 0x2d, 0xf2, 0x1d, 0xf4, 0xcf, 0x51, 0x97, 0x1e,
+	0x14, 0xf2, 0x81, 0xf7, 0xdc, 0xf5, 0x50, 0x0d, 0xee, 0xed, 0xde, 0x74, 0x77, 0x12, 0xdf, 0x22,
+	0xcf, 0xe1, 0xc8, 0x8e, 0xf6, 0xa2, 0xf8, 0xc8, 0xff, 0x4a, 0x43, 0xdf, 0x47, 0x3a, 0xad, 0x27,
+	0x64, 0xc7, 0x7e, 0x7c, 0xeb, 0x49, 0x30, 0xfe, 0xab, 0x01, 0xd1, 0xb3, 0xe9, 0x92, 0x0b, 0xf2,
+	0x0a, 0xfa, 0x55, 0x31, 0x93, 0xfb, 0xfe, 0xe8, 0x9e, 0xf1, 0x3c, 0x78, 0xb0, 0x77, 0x7f, 0x93,
+	0xe7, 0x0f, 0x70, 0x54, 0x13, 0x11, 0xc9, 0xcf, 0xed, 0xd3, 0xef, 0x60, 0xb8, 0xdf, 0x61, 0x13,
+	0xf9, 0x15, 0xf4, 0xab, 0xcc, 0xde, 0x24, 0xbc, 0x47, 0x34, 0x83, 0x07, 0x7b, 0xf7, 0x37, 0x61,
+	0x9f, 0x42, 0xe7, 0x1c, 0xb5, 0xe3, 0x20, 0x39, 0xf6, 0xfe, 0x25, 0xe2, 0x0e, 0xee, 0x56, 0xd0,
+	0xfc, 0xec, 0x9b, 0xa6, 0xc5, 0x3f, 0xf9, 0x67, 0x00, 0x16, 0xe4, 0x2b, 0x32, 0xc7, 0x0a, 0x00,
+	0x00,
 }
@@ -2,14 +2,23 @@ package proto
 
 import (
 	"crypto/tls"
+
+	"golang.org/x/crypto/acme"
 )
 
+// RetryAfterKey is the trailer the server sets on ResourceExhausted
+// errors to the number of seconds to wait before asking again.
+const RetryAfterKey = "retry-after"
+
 func ClientHelloInfoToProto(clientHello *tls.ClientHelloInfo) *ClientHelloInfo {
 	chi := ClientHelloInfo{
-		Ciphersuites:    make([]uint32, len(clientHello.CipherSuites)),
-		Servername:      clientHello.ServerName,
-		Supportedcurves: make([]uint32, len(clientHello.SupportedCurves)),
-		Supportedpoints: []byte(clientHello.SupportedPoints),
+		Ciphersuites:      make([]uint32, len(clientHello.CipherSuites)),
+		Servername:        clientHello.ServerName,
+		Supportedcurves:   make([]uint32, len(clientHello.SupportedCurves)),
+		Supportedpoints:   []byte(clientHello.SupportedPoints),
+		Supportedprotos:   clientHello.SupportedProtos,
+		Signatureschemes:  make([]uint32, len(clientHello.SignatureSchemes)),
+		Supportedversions: make([]uint32, len(clientHello.SupportedVersions)),
 	}
 
 	for i, cs := range clientHello.CipherSuites {
@@ -20,24 +29,130 @@ func ClientHelloInfoToProto(clientHello *tls.ClientHelloInfo) *ClientHelloInfo {
 		chi.Supportedcurves[i] = uint32(sc)
 	}
 
+	for i, ss := range clientHello.SignatureSchemes {
+		chi.Signatureschemes[i] = uint32(ss)
+	}
+
+	for i, sv := range clientHello.SupportedVersions {
+		chi.Supportedversions[i] = uint32(sv)
+	}
+
 	return &chi
 }
 
+// ProtoToClientHelloInfo converts clientHello back to a tls.ClientHelloInfo.
+// Lists that were empty are left nil, as crypto/tls does for extensions
+// the client did not send.
 func ProtoToClientHelloInfo(clientHello *ClientHelloInfo) *tls.ClientHelloInfo {
 	chi := tls.ClientHelloInfo{
-		CipherSuites:    make([]uint16, len(clientHello.Ciphersuites)),
 		ServerName:      clientHello.Servername,
-		SupportedCurves: make([]tls.CurveID, len(clientHello.Supportedcurves)),
 		SupportedPoints: []uint8(clientHello.Supportedpoints),
+		SupportedProtos: clientHello.Supportedprotos,
 	}
 
-	for i, cs := range clientHello.Ciphersuites {
-		chi.CipherSuites[i] = uint16(cs)
+	if len(clientHello.Ciphersuites) > 0 {
+		chi.CipherSuites = make([]uint16, len(clientHello.Ciphersuites))
+		for i, cs := range clientHello.Ciphersuites {
+			chi.CipherSuites[i] = uint16(cs)
+		}
 	}
 
-	for i, sc := range clientHello.Supportedcurves {
-		chi.SupportedCurves[i] = tls.CurveID(sc)
+	if len(clientHello.Supportedcurves) > 0 {
+		chi.SupportedCurves = make([]tls.CurveID, len(clientHello.Supportedcurves))
+		for i, sc := range clientHello.Supportedcurves {
+			chi.SupportedCurves[i] = tls.CurveID(sc)
+		}
+	}
+
+	if len(clientHello.Signatureschemes) > 0 {
+		chi.SignatureSchemes = make([]tls.SignatureScheme, len(clientHello.Signatureschemes))
+		for i, ss := range clientHello.Signatureschemes {
+			chi.SignatureSchemes[i] = tls.SignatureScheme(ss)
+		}
+	}
+
+	if len(clientHello.Supportedversions) > 0 {
+		chi.SupportedVersions = make([]uint16, len(clientHello.Supportedversions))
+		for i, sv := range clientHello.Supportedversions {
+			chi.SupportedVersions[i] = uint16(sv)
+		}
 	}
 
 	return &chi
 }
+
+// CertKey returns the key certificates for clientHello are stored under,
+// following the autocert cache layout: the server name for ECDSA
+// certificates, the server name with a "+rsa" suffix for RSA and with
+// a "+token" suffix for TLS-ALPN-01 challenge certificates.
+func CertKey(clientHello *tls.ClientHelloInfo) string {
+	if WantsChallengeCert(clientHello) {
+		return clientHello.ServerName + "+token"
+	}
+	if SupportsECDSA(clientHello) {
+		return clientHello.ServerName
+	}
+	return clientHello.ServerName + "+rsa"
+}
+
+// WantsChallengeCert reports whether clientHello is a TLS-ALPN-01
+// validation handshake, which advertises the "acme-tls/1" protocol.
+// See RFC 8737.
+func WantsChallengeCert(clientHello *tls.ClientHelloInfo) bool {
+	for _, p := range clientHello.SupportedProtos {
+		if p == acme.ALPNProto {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportsECDSA reports whether the client that sent clientHello
+// can use an ECDSA certificate.
+//
+// Copied from golang.org/x/crypto/acme/autocert/autocert.go.
+func SupportsECDSA(clientHello *tls.ClientHelloInfo) bool {
+	// The "signature_algorithms" extension, if present, limits the key exchange
+	// algorithms allowed by the cipher suites. See RFC 5246, section 7.4.1.4.1.
+	if clientHello.SignatureSchemes != nil {
+		ecdsaOK := false
+	schemeLoop:
+		for _, scheme := range clientHello.SignatureSchemes {
+			const tlsECDSAWithSHA1 tls.SignatureScheme = 0x0203 // constant added in Go 1.10
+			switch scheme {
+			case tlsECDSAWithSHA1, tls.ECDSAWithP256AndSHA256,
+				tls.ECDSAWithP384AndSHA384, tls.ECDSAWithP521AndSHA512:
+				ecdsaOK = true
+				break schemeLoop
+			}
+		}
+		if !ecdsaOK {
+			return false
+		}
+	}
+	if clientHello.SupportedCurves != nil {
+		ecdsaOK := false
+		for _, curve := range clientHello.SupportedCurves {
+			if curve == tls.CurveP256 {
+				ecdsaOK = true
+				break
+			}
+		}
+		if !ecdsaOK {
+			return false
+		}
+	}
+	for _, suite := range clientHello.CipherSuites {
+		switch suite {
+		case tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package proto
+
+import (
+	"crypto/tls"
+	"reflect"
+	"testing"
+)
+
+func TestClientHelloInfoRoundTrip(t *testing.T) {
+	chi := &tls.ClientHelloInfo{
+		CipherSuites:      []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		ServerName:        "example.com",
+		SupportedCurves:   []tls.CurveID{tls.X25519, tls.CurveP256},
+		SupportedPoints:   []uint8{0},
+		SignatureSchemes:  []tls.SignatureScheme{tls.PSSWithSHA256, tls.ECDSAWithP256AndSHA256},
+		SupportedProtos:   []string{"h2", "http/1.1"},
+		SupportedVersions: []uint16{tls.VersionTLS13, tls.VersionTLS12},
+	}
+
+	got := ProtoToClientHelloInfo(ClientHelloInfoToProto(chi))
+	if !reflect.DeepEqual(got, chi) {
+		t.Fatalf("expected %+v, got %+v", chi, got)
+	}
+}
+
+func TestClientHelloInfoEmptyLists(t *testing.T) {
+	chi := &tls.ClientHelloInfo{
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		ServerName:   "example.com",
+	}
+
+	got := ProtoToClientHelloInfo(ClientHelloInfoToProto(chi))
+	if got.SupportedCurves != nil || got.SignatureSchemes != nil {
+		t.Fatalf("expected absent extensions to stay nil, got %+v", got)
+	}
+
+	if !SupportsECDSA(got) {
+		t.Fatalf("expected ECDSA support without curves or signature schemes")
+	}
+}
+
+func TestCertKey(t *testing.T) {
+	tests := []struct {
+		chi  *tls.ClientHelloInfo
+		want string
+	}{
+		{
+			&tls.ClientHelloInfo{
+				ServerName:       "example.com",
+				CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+				SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			},
+			"example.com",
+		},
+		{
+			&tls.ClientHelloInfo{
+				ServerName:       "example.com",
+				CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+				SignatureSchemes: []tls.SignatureScheme{tls.PKCS1WithSHA256},
+			},
+			"example.com+rsa",
+		},
+		{
+			&tls.ClientHelloInfo{
+				ServerName:   "example.com",
+				CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+			},
+			"example.com+rsa",
+		},
+		{
+			&tls.ClientHelloInfo{
+				ServerName:      "example.com",
+				CipherSuites:    []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+				SupportedProtos: []string{"acme-tls/1"},
+			},
+			"example.com+token",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := CertKey(tt.chi); got != tt.want {
+			t.Errorf("CertKey(%+v) = %q, want %q", tt.chi, got, tt.want)
+		}
+	}
+}
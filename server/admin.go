@@ -0,0 +1,470 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/offblast/achmed/proto"
+)
+
+const (
+	// defaultPageSize and maxPageSize bound the certificates listed per page.
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// RegisterAdmin registers the Admin service with serv. Only the admins
+// of the server's Authorizer may use it, without one nobody can.
+func (a *AchmedServer) RegisterAdmin(serv *grpc.Server) {
+	proto.RegisterAdminServer(serv, a)
+}
+
+func (a *AchmedServer) authorizeAdmin(ctx context.Context) error {
+	if a.auth == nil {
+		return grpc.Errorf(codes.PermissionDenied, "achmed: the Admin service needs an authorizer")
+	}
+
+	if err := a.auth.AuthorizeAdmin(ctx); err != nil {
+		return grpc.Errorf(codes.PermissionDenied, "achmed: %v", err)
+	}
+
+	return nil
+}
+
+// ListCertificates returns a page of the certificates in the cache, in
+// the order of their cache keys. It needs a cache implementing Lister.
+func (a *AchmedServer) ListCertificates(ctx context.Context, req *proto.ListCertificatesRequest) (*proto.ListCertificatesResponse, error) {
+	if err := a.authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	lister, ok := a.cache.(Lister)
+	if !ok {
+		return nil, grpc.Errorf(codes.FailedPrecondition, "achmed: the cache can't list certificates")
+	}
+
+	size := int(req.Pagesize)
+	switch {
+	case size < 0:
+		return nil, grpc.Errorf(codes.InvalidArgument, "achmed: invalid page size %d", size)
+	case size == 0:
+		size = defaultPageSize
+	case size > maxPageSize:
+		size = maxPageSize
+	}
+
+	var filter *HostRules
+	if req.Name != "" {
+		filter = &HostRules{}
+		if strings.HasPrefix(req.Name, ".") {
+			filter.Suffixes = []string{req.Name[1:]}
+		} else {
+			filter.Exact = []string{req.Name}
+		}
+	}
+
+	keys, err := lister.List(ctx)
+	if err != nil {
+		return nil, grpc.Errorf(codes.Unavailable, "achmed: failed to list certificates: %v", err)
+	}
+	sort.Strings(keys)
+
+	// the page token is the key of the last certificate of the previous page.
+	start := sort.SearchStrings(keys, req.Pagetoken)
+	if start < len(keys) && keys[start] == req.Pagetoken {
+		start++
+	}
+
+	resp := &proto.ListCertificatesResponse{}
+
+	for _, key := range keys[start:] {
+		cert := a.cachedCertificate(ctx, key)
+		if cert == nil {
+			continue
+		}
+
+		if req.Expiringwithin > 0 && cert.Leaf.NotAfter.After(time.Now().Add(time.Duration(req.Expiringwithin)*time.Second)) {
+			continue
+		}
+
+		if filter != nil && !allowsAny(filter, cert.Leaf.DNSNames) {
+			continue
+		}
+
+		// only point to a next page that has a certificate on it.
+		if len(resp.Certificates) == size {
+			resp.Nextpagetoken = resp.Certificates[size-1].Key
+			break
+		}
+
+		resp.Certificates = append(resp.Certificates, a.certificateInfo(ctx, key, cert))
+	}
+
+	return resp, nil
+}
+
+// RevokeCertificate revokes the certificate stored under a cache key with
+// the ACME server, and removes it from the cache. With reissue, a new
+// certificate for the same names is issued right away, else on the next
+// request. Revocations are logged with the caller's identity.
+//
+// Other replicas sharing the cache stop serving the revoked certificate
+// within a minute.
+func (a *AchmedServer) RevokeCertificate(ctx context.Context, req *proto.RevokeCertificateRequest) (*proto.RevokeCertificateResponse, error) {
+	if err := a.authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	if a.issuer == nil {
+		return nil, grpc.Errorf(codes.FailedPrecondition, "achmed: revocation needs an ACME client with a key")
+	}
+
+	// reason code 7 is not used.
+	reason := acme.CRLReasonCode(req.Reason)
+	if reason < acme.CRLReasonUnspecified || reason > acme.CRLReasonAACompromise || reason == 7 {
+		return nil, grpc.Errorf(codes.InvalidArgument, "achmed: invalid reason code %d", req.Reason)
+	}
+
+	cert := a.cachedCertificate(ctx, req.Key)
+	if cert == nil {
+		return nil, grpc.Errorf(codes.NotFound, "achmed: no certificate %q", req.Key)
+	}
+
+	var names []string
+	if req.Reissue {
+		if names = a.renewalNames(ctx, req.Key, cert.Leaf); len(names) == 0 {
+			return nil, grpc.Errorf(codes.FailedPrecondition, "achmed: certificate %q can't be reissued", req.Key)
+		}
+	}
+
+	key, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, grpc.Errorf(codes.Internal, "achmed: unsupported key of certificate %q", req.Key)
+	}
+
+	resp := &proto.RevokeCertificateResponse{Revoked: a.certificateInfo(ctx, req.Key, cert)}
+	caller := a.clientKey(ctx)
+
+	// signing with the certificate's key works regardless of the account.
+	if err := a.m.Client.RevokeCert(ctx, key, cert.Leaf.Raw, reason); err != nil {
+		log.Printf("achmed: audit: %q failed to revoke certificate %q (serial %s, reason %d): %v", caller, req.Key, resp.Revoked.Serial, reason, err)
+		return nil, grpc.Errorf(codes.Unavailable, "achmed: failed to revoke certificate %q: %v", req.Key, err)
+	}
+
+	log.Printf("achmed: audit: %q revoked certificate %q (serial %s, names %v, reason %d)", caller, req.Key, resp.Revoked.Serial, cert.Leaf.DNSNames, reason)
+
+	// autocert would keep serving its copy of the certificate, on this
+	// and other replicas.
+	if err := a.markReplaced(ctx, req.Key, cert); err != nil {
+		return nil, grpc.Errorf(codes.Unavailable, "achmed: revoked certificate %q, but failed to mark it in the cache: %v", req.Key, err)
+	}
+	a.issuer.forget(req.Key)
+	a.encoded.delete(req.Key)
+
+	if err := a.m.Cache.Delete(ctx, req.Key); err != nil {
+		return nil, grpc.Errorf(codes.Unavailable, "achmed: revoked certificate %q, but failed to remove it from the cache: %v", req.Key, err)
+	}
+	a.watchers.notify(req.Key)
+
+	if !req.Reissue {
+		return resp, nil
+	}
+
+	if err := a.issuer.renewNow(ctx, req.Key, names, strings.HasSuffix(req.Key, "+rsa"), cert); err != nil {
+		return nil, grpc.Errorf(codes.Unavailable, "achmed: revoked certificate %q, but failed to reissue it: %v", req.Key, err)
+	}
+
+	if cert := a.cachedCertificate(ctx, req.Key); cert != nil {
+		resp.Reissued = a.certificateInfo(ctx, req.Key, cert)
+		log.Printf("achmed: audit: %q reissued certificate %q (serial %s)", caller, req.Key, resp.Reissued.Serial)
+	}
+
+	return resp, nil
+}
+
+// RenewCertificate orders a new certificate for a server name or bundle,
+// however long the current one is still valid, and replaces the current
+// one in the cache. Renewals are logged with the caller's identity.
+//
+// The new certificate is served by this server right away, and within a
+// minute by other replicas sharing the cache. If the certificate is being
+// renewed already, an Aborted error is returned.
+func (a *AchmedServer) RenewCertificate(ctx context.Context, req *proto.RenewCertificateRequest) (*proto.RenewCertificateResponse, error) {
+	if err := a.authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	if a.issuer == nil {
+		return nil, grpc.Errorf(codes.FailedPrecondition, "achmed: renewal needs an ACME client with a key")
+	}
+
+	key, names, err := a.renewalTarget(ctx, req.Name, req.Rsa)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.issuances.check(ctx, names); err != nil {
+		if rl, ok := err.(*RateLimitError); ok {
+			return nil, retryAfter(ctx, rl.RetryAfter.Sub(time.Now()), grpc.Errorf(codes.ResourceExhausted, "%v", err))
+		}
+		return nil, grpc.Errorf(codes.Unavailable, "achmed: %v", err)
+	}
+
+	resp := &proto.RenewCertificateResponse{}
+	caller := a.clientKey(ctx)
+
+	old := a.cachedCertificate(ctx, key)
+	if old == nil {
+		old = a.issuer.certificate(key)
+	}
+	if old != nil {
+		resp.Previous = a.certificateInfo(ctx, key, old)
+	}
+
+	if err := a.issuer.renewNow(ctx, key, names, req.Rsa, old); err != nil {
+		log.Printf("achmed: audit: %q failed to renew certificate %q: %v", caller, key, err)
+		return nil, grpc.Errorf(codes.Unavailable, "achmed: failed to renew certificate %q: %v", key, err)
+	}
+
+	// renewNow does nothing while the certificate is being renewed.
+	cert := a.issuer.certificate(key)
+	if cert == nil || !replaced(cert, old) {
+		return nil, grpc.Errorf(codes.Aborted, "achmed: certificate %q is already being renewed", key)
+	}
+	resp.Certificate = a.certificateInfo(ctx, key, cert)
+
+	if err := a.markReplaced(ctx, key, old); err != nil {
+		log.Printf("achmed: failed to mark certificate %q as renewed: %v", key, err)
+	}
+
+	log.Printf("achmed: audit: %q renewed certificate %q (serial %s, names %v)", caller, key, resp.Certificate.Serial, names)
+
+	return resp, nil
+}
+
+// GetBudget returns the remaining weekly issuance budget of the registered
+// domain of a name, see WithLimits.
+func (a *AchmedServer) GetBudget(ctx context.Context, req *proto.BudgetRequest) (*proto.BudgetResponse, error) {
+	if err := a.authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	if a.issuances == nil {
+		return nil, grpc.Errorf(codes.FailedPrecondition, "achmed: no issuance limits configured")
+	}
+
+	name := normalizeHost(req.Name)
+	if name == "" {
+		return nil, grpc.Errorf(codes.InvalidArgument, "achmed: missing name")
+	}
+
+	b, err := a.Budget(ctx, name)
+	if err != nil {
+		return nil, grpc.Errorf(codes.Unavailable, "achmed: failed to get budget of %q: %v", name, err)
+	}
+
+	resp := &proto.BudgetResponse{
+		Domain:    b.Domain,
+		Limit:     int32(b.Limit),
+		Used:      int32(b.Used),
+		Remaining: int32(b.Remaining),
+	}
+	if !b.Reset.IsZero() {
+		resp.Resetat = b.Reset.Unix()
+	}
+
+	return resp, nil
+}
+
+// renewalTarget returns the cache key and the names of the certificate
+// for name, a server name or the name of a bundle.
+func (a *AchmedServer) renewalTarget(ctx context.Context, name string, useRSA bool) (string, []string, error) {
+	for n := range a.bundleList {
+		if b := &a.bundleList[n]; b.Name == name {
+			return b.key(useRSA), normalizedNames(b.Names), nil
+		}
+	}
+
+	host := normalizeHost(name)
+	if host == "" {
+		return "", nil, grpc.Errorf(codes.InvalidArgument, "achmed: missing name")
+	}
+
+	if a.hostPolicy != nil {
+		if err := a.hostPolicy(ctx, host); err != nil {
+			return "", nil, grpc.Errorf(codes.PermissionDenied, "achmed: host %q not allowed: %v", host, err)
+		}
+	}
+
+	if b, ok := a.bundles[host]; ok {
+		return b.key(useRSA), normalizedNames(b.Names), nil
+	}
+
+	if a.identities != nil {
+		host = normalizeHost(a.identities(host))
+		if strings.HasPrefix(host, "*.") && a.dns == nil {
+			return "", nil, grpc.Errorf(codes.FailedPrecondition, "achmed: host %q maps to %q, which needs DNS-01", name, host)
+		}
+	}
+
+	return certKey(host, useRSA), []string{host}, nil
+}
+
+// replacedMarker is stored under "<key>+replaced" when the certificate
+// stored under key is revoked or renewed through the Admin service, so
+// that all replicas sharing the cache stop serving their copy of it.
+type replacedMarker struct {
+	Serial   string    `json:"serial"`
+	NotAfter time.Time `json:"notafter"`
+}
+
+func replacedKey(key string) string {
+	return key + "+replaced"
+}
+
+// markReplaced records that old, stored under key, was revoked or renewed.
+func (a *AchmedServer) markReplaced(ctx context.Context, key string, old *tls.Certificate) error {
+	a.mu.Lock()
+	a.replaced[key] = true
+	delete(a.served, key)
+	a.mu.Unlock()
+
+	if a.cache == nil || old == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(replacedMarker{
+		Serial:   fmt.Sprintf("%x", old.Leaf.SerialNumber),
+		NotAfter: old.Leaf.NotAfter,
+	})
+	if err != nil {
+		return err
+	}
+
+	return a.cache.Put(ctx, replacedKey(key), data)
+}
+
+// loadReplacedMarker returns the marker stored for key in c, or nil if
+// there is none.
+func loadReplacedMarker(ctx context.Context, c autocert.Cache, key string) *replacedMarker {
+	data, err := c.Get(ctx, replacedKey(key))
+	if err != nil {
+		return nil
+	}
+
+	var marker replacedMarker
+	if err := json.Unmarshal(data, &marker); err != nil {
+		return nil
+	}
+
+	return &marker
+}
+
+// wasReplaced reports whether the certificate stored under key was
+// revoked or renewed through the Admin service of any replica, as long as
+// the old certificate is valid. Markers in the cache are looked up once a
+// minute.
+func (a *AchmedServer) wasReplaced(ctx context.Context, key string) bool {
+	a.mu.Lock()
+	replaced := a.replaced[key]
+	checked := a.replacedChecked[key]
+	a.mu.Unlock()
+
+	if replaced || a.cache == nil || time.Since(checked) < time.Minute {
+		return replaced
+	}
+
+	if marker := loadReplacedMarker(ctx, a.cache, key); marker != nil {
+		replaced = time.Now().Before(marker.NotAfter)
+	}
+
+	a.mu.Lock()
+	a.replacedChecked[key] = time.Now()
+	if replaced {
+		a.replaced[key] = true
+	}
+	a.mu.Unlock()
+
+	return replaced
+}
+
+// cachedCertificate returns the certificate stored under key in the
+// cache, nil if there is none or the entry is no certificate.
+func (a *AchmedServer) cachedCertificate(ctx context.Context, key string) *tls.Certificate {
+	// TLS-ALPN-01 challenge certificates.
+	if a.cache == nil || strings.HasSuffix(key, "+token") {
+		return nil
+	}
+
+	data, err := a.cache.Get(ctx, key)
+	if err != nil {
+		return nil
+	}
+
+	cert, err := parseCertificatePEM(data)
+	if err != nil {
+		return nil
+	}
+
+	return cert
+}
+
+func (a *AchmedServer) certificateInfo(ctx context.Context, key string, cert *tls.Certificate) *proto.CertificateInfo {
+	leaf := cert.Leaf
+
+	info := &proto.CertificateInfo{
+		Key:       key,
+		Name:      leaf.Subject.CommonName,
+		Dnsnames:  leaf.DNSNames,
+		Issuer:    leaf.Issuer.CommonName,
+		Serial:    fmt.Sprintf("%x", leaf.SerialNumber),
+		Notbefore: leaf.NotBefore.Unix(),
+		Notafter:  leaf.NotAfter.Unix(),
+		Keytype:   keyType(leaf.PublicKey),
+	}
+
+	if a.issuer != nil {
+		if ra, ok := a.issuer.renewals.last(ctx, key); ok {
+			info.Lastrenewal = ra.Time.Unix()
+			info.Lastrenewalerror = ra.Error
+		}
+	}
+
+	return info
+}
+
+// keyType describes the type and size of a public key.
+func keyType(pub interface{}) string {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		return "ECDSA " + k.Curve.Params().Name
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", k.N.BitLen())
+	default:
+		return fmt.Sprintf("%T", pub)
+	}
+}
+
+// allowsAny reports whether rules allow any of names.
+func allowsAny(rules *HostRules, names []string) bool {
+	for _, name := range names {
+		if rules.Allowed(name) {
+			return true
+		}
+	}
+	return false
+}
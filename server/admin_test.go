@@ -0,0 +1,434 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/offblast/achmed/proto"
+)
+
+// testAdmin returns the option setting the authorizer of testACL, and a
+// context with the credentials of its admin.
+func testAdmin(t *testing.T) (Option, context.Context) {
+	auth, err := ParseAuthorizer(strings.NewReader(testACL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return WithAuthorizer(auth), metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer 4dm1n"))
+}
+
+func TestAdminNeedsAuthorizer(t *testing.T) {
+	a, err := New("", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, ctx := testAdmin(t)
+	if err := a.authorizeAdmin(ctx); grpc.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected admin calls to be denied without an authorizer, got %v", err)
+	}
+
+	opt, ctx := testAdmin(t)
+	if a, err = New("", nil, nil, nil, opt); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.authorizeAdmin(ctx); err != nil {
+		t.Fatalf("expected admin to be allowed, got %v", err)
+	}
+
+	if err := a.authorizeAdmin(context.Background()); grpc.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected unauthenticated caller to be denied, got %v", err)
+	}
+}
+
+func TestListCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "achmed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	c := &listCache{DirCache: autocert.DirCache(dir)}
+
+	put := func(key string, data []byte) {
+		if err := c.Put(ctx, key, data); err != nil {
+			t.Fatal(err)
+		}
+		c.keys = append(c.keys, key)
+	}
+
+	for _, name := range []string{"a.example.com", "b.example.com", "c.example.com", "example.org"} {
+		data, err := certificatePEM(selfSigned(t, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		put(name, data)
+	}
+
+	soon, err := certificatePEM(selfSignedUntil(t, time.Now().Add(time.Hour), "d.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	put("d.example.com", soon)
+	put("d.example.com+token", soon)
+	put("example.com+issuances", []byte("[]"))
+
+	opt, admin := testAdmin(t)
+	a, err := New("", c, nil, nil, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.ListCertificates(ctx, &proto.ListCertificatesRequest{}); err == nil {
+		t.Fatalf("expected unauthenticated caller to be rejected")
+	}
+
+	ctx = admin
+
+	list := func(req *proto.ListCertificatesRequest) []string {
+		resp, err := a.ListCertificates(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var keys []string
+		for _, info := range resp.Certificates {
+			keys = append(keys, info.Key)
+		}
+		if resp.Nextpagetoken != "" {
+			keys = append(keys, "next="+resp.Nextpagetoken)
+		}
+		return keys
+	}
+
+	tests := []struct {
+		req  *proto.ListCertificatesRequest
+		want string
+	}{
+		{&proto.ListCertificatesRequest{}, "a.example.com b.example.com c.example.com d.example.com example.org"},
+		{&proto.ListCertificatesRequest{Pagesize: 2}, "a.example.com b.example.com next=b.example.com"},
+		{&proto.ListCertificatesRequest{Pagesize: 2, Pagetoken: "b.example.com"}, "c.example.com d.example.com next=d.example.com"},
+		{&proto.ListCertificatesRequest{Pagesize: 2, Pagetoken: "d.example.com"}, "example.org"},
+		{&proto.ListCertificatesRequest{Name: "example.org"}, "example.org"},
+		{&proto.ListCertificatesRequest{Name: ".example.com"}, "a.example.com b.example.com c.example.com d.example.com"},
+		{&proto.ListCertificatesRequest{Expiringwithin: 24 * 60 * 60}, "d.example.com"},
+		{&proto.ListCertificatesRequest{Pagesize: 4, Name: ".example.com"}, "a.example.com b.example.com c.example.com d.example.com"},
+		{&proto.ListCertificatesRequest{Pagesize: 1, Pagetoken: "c.example.com", Name: ".example.com"}, "d.example.com"},
+		{&proto.ListCertificatesRequest{Pagesize: 1, Expiringwithin: 24 * 60 * 60}, "d.example.com"},
+	}
+
+	for _, tt := range tests {
+		if got := strings.Join(list(tt.req), " "); got != tt.want {
+			t.Errorf("ListCertificates(%v) = %q, want %q", tt.req, got, tt.want)
+		}
+	}
+
+	resp, err := a.ListCertificates(ctx, &proto.ListCertificatesRequest{Name: "example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := resp.Certificates[0]
+	if info.Name != "example.org" || len(info.Dnsnames) != 1 || info.Issuer != "example.org" || info.Serial != "2a" || info.Keytype != "ECDSA P-256" {
+		t.Fatalf("unexpected certificate info %+v", info)
+	}
+}
+
+// testACME is an ACME server that only revokes certificates.
+type testACME struct {
+	*httptest.Server
+	revoked int
+}
+
+func newTestACME() *testACME {
+	s := &testACME{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+
+		switch r.URL.Path {
+		case "/directory":
+			fmt.Fprintf(w, `{"newNonce": %q, "newOrder": %q, "revokeCert": %q}`, s.URL+"/nonce", s.URL+"/order", s.URL+"/revoke")
+		case "/revoke":
+			s.revoked++
+		}
+	}))
+	return s
+}
+
+func TestRevokeCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "achmed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := newTestACME()
+	defer srv.Close()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opt, ctx := testAdmin(t)
+	c := autocert.DirCache(dir)
+
+	data, err := certificatePEM(selfSigned(t, "example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put(ctx, "example.com", data); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := New("", c, &acme.Client{Key: key, DirectoryURL: srv.URL + "/directory"}, nil, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.RevokeCertificate(ctx, &proto.RevokeCertificateRequest{Key: "example.com", Reason: 7}); grpc.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected invalid reason to be rejected, got %v", err)
+	}
+
+	if _, err := a.RevokeCertificate(ctx, &proto.RevokeCertificateRequest{Key: "example.org"}); grpc.Code(err) != codes.NotFound {
+		t.Fatalf("expected unknown certificate to be rejected, got %v", err)
+	}
+
+	resp, err := a.RevokeCertificate(ctx, &proto.RevokeCertificateRequest{Key: "example.com", Reason: int32(acme.CRLReasonKeyCompromise)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if srv.revoked != 1 || resp.Revoked.Serial != "2a" || resp.Reissued != nil {
+		t.Fatalf("expected certificate to be revoked once, got %d revocations and %+v", srv.revoked, resp)
+	}
+
+	if _, err := c.Get(ctx, "example.com"); err != autocert.ErrCacheMiss {
+		t.Fatalf("expected revoked certificate to be removed from the cache, got %v", err)
+	}
+
+	if !a.wasReplaced(ctx, "example.com") || a.wasReplaced(ctx, "example.org") {
+		t.Fatalf("expected only example.com to be marked revoked")
+	}
+}
+
+func TestRevokeCertificateReplicas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "achmed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := newTestACME()
+	defer srv.Close()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opt, admin := testAdmin(t)
+	ctx := context.Background()
+	c := autocert.DirCache(dir)
+
+	put := func() string {
+		cert := selfSigned(t, "example.com")
+		data, err := certificatePEM(cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Put(ctx, "example.com", data); err != nil {
+			t.Fatal(err)
+		}
+		return fingerprint(cert.Leaf.Raw)
+	}
+
+	revoked := put()
+
+	// a revokes, b serves certificates with autocert, r with its issuer.
+	replica := func(opts ...Option) *AchmedServer {
+		a, err := New("", c, &acme.Client{Key: key, DirectoryURL: srv.URL + "/directory"}, nil, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	a, b, r := replica(opt), replica(), replica(WithRenewal(Renewal{}))
+
+	hello := &proto.ClientHelloInfo{Servername: "example.com", Ciphersuites: []uint32{0xc02b}, Supportedcurves: []uint32{23}}
+
+	for _, s := range []*AchmedServer{b, r} {
+		if cert, err := s.GetCertificate(ctx, hello); err != nil || cert.Fingerprint != revoked {
+			t.Fatalf("expected cached certificate, got %v, %v", cert, err)
+		}
+	}
+
+	if _, err := a.RevokeCertificate(admin, &proto.RevokeCertificateRequest{Key: "example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a minute later.
+	b.mu.Lock()
+	delete(b.replacedChecked, "example.com")
+	b.mu.Unlock()
+	r.issuer.mu.Lock()
+	delete(r.issuer.reloaded, "example.com")
+	r.issuer.mu.Unlock()
+
+	// the test ACME server can't issue certificates.
+	for _, s := range []*AchmedServer{b, r} {
+		if cert, err := s.GetCertificate(ctx, hello); err == nil {
+			t.Fatalf("expected revoked certificate not to be served, got %s", cert.Fingerprint)
+		}
+	}
+
+	reissued := put()
+
+	for _, s := range []*AchmedServer{b, r} {
+		if cert, err := s.GetCertificate(ctx, hello); err != nil || cert.Fingerprint != reissued {
+			t.Fatalf("expected reissued certificate, got %v, %v", cert, err)
+		}
+	}
+}
+
+func TestRenewalTarget(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opt, ctx := testAdmin(t)
+	policy := (&HostRules{Suffixes: []string{"example.com"}}).HostPolicy()
+	a, err := New("", nil, &acme.Client{Key: key}, policy, opt,
+		WithBundles(Bundle{Name: "www", Names: []string{"example.com", "WWW.example.com"}}),
+		WithIdentities(WildcardIdentities("users.example.com")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		rsa   bool
+		key   string
+		names string
+		code  codes.Code
+	}{
+		{"www", false, "www+bundle", "example.com www.example.com", codes.OK},
+		{"www.example.com", true, "www+bundle+rsa", "example.com www.example.com", codes.OK},
+		{"mail.example.com.", false, "mail.example.com", "mail.example.com", codes.OK},
+		{"mail.example.com", true, "mail.example.com+rsa", "mail.example.com", codes.OK},
+		{"alice.users.example.com", false, "", "", codes.FailedPrecondition},
+		{"example.org", false, "", "", codes.PermissionDenied},
+		{"", false, "", "", codes.InvalidArgument},
+	}
+
+	for _, tt := range tests {
+		key, names, err := a.renewalTarget(ctx, tt.name, tt.rsa)
+		if grpc.Code(err) != tt.code || key != tt.key || strings.Join(names, " ") != tt.names {
+			t.Errorf("renewalTarget(%q, %v) = %q, %v, %v, want %q, %v, %v", tt.name, tt.rsa, key, names, err, tt.key, tt.names, tt.code)
+		}
+	}
+
+	if _, err := a.RenewCertificate(ctx, &proto.RenewCertificateRequest{Name: "example.org"}); grpc.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected renewal of a denied host to fail, got %v", err)
+	}
+}
+
+func TestRenewCertificateInFlight(t *testing.T) {
+	dir, err := ioutil.TempDir("", "achmed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opt, ctx := testAdmin(t)
+	c := autocert.DirCache(dir)
+
+	data, err := certificatePEM(selfSigned(t, "example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put(ctx, "example.com", data); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := New("", c, &acme.Client{Key: key}, nil, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// e.g. by Renew.
+	a.issuer.renewing["example.com"] = true
+
+	if _, err := a.RenewCertificate(ctx, &proto.RenewCertificateRequest{Name: "example.com"}); grpc.Code(err) != codes.Aborted {
+		t.Fatalf("expected renewal in flight to be reported, got %v", err)
+	}
+
+	if a.wasReplaced(ctx, "example.com") {
+		t.Fatalf("expected certificate not to be marked renewed")
+	}
+}
+
+func TestGetBudget(t *testing.T) {
+	opt, ctx := testAdmin(t)
+
+	a, err := New("", nil, nil, nil, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.GetBudget(ctx, &proto.BudgetRequest{Name: "example.com"}); grpc.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected budget without limits to fail, got %v", err)
+	}
+
+	if a, err = New("", nil, nil, nil, opt, WithLimits(Limits{PerDomain: 5})); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.GetBudget(context.Background(), &proto.BudgetRequest{Name: "example.com"}); grpc.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected unauthenticated caller to be rejected, got %v", err)
+	}
+
+	if _, err := a.GetBudget(ctx, &proto.BudgetRequest{}); grpc.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected missing name to be rejected, got %v", err)
+	}
+
+	for _, name := range []string{"www.example.com", "mail.example.com"} {
+		if err := a.issuances.record(ctx, []string{name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err := a.GetBudget(ctx, &proto.BudgetRequest{Name: "api.example.com."})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Domain != "example.com" || resp.Limit != 5 || resp.Used != 2 || resp.Remaining != 3 || resp.Resetat <= time.Now().Unix() {
+		t.Fatalf("unexpected budget %+v", resp)
+	}
+}
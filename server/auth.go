@@ -0,0 +1,148 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// ErrNoIdentity is returned by Authorizer.Identity for callers that
+// presented neither a verified client certificate nor a known bearer token.
+var ErrNoIdentity = errors.New("achmed: caller not authenticated")
+
+// Authorizer maps gRPC callers to the host names they may request
+// certificates for.
+//
+// Callers are identified by the common name of a verified TLS client
+// certificate, or by a bearer token in the "authorization" metadata.
+type Authorizer struct {
+	// Tokens maps bearer tokens to client identities.
+	Tokens map[string]string
+
+	// Clients maps client identities to the host names they may request.
+	Clients map[string]*HostRules
+
+	// Admins are the client identities allowed to use the Admin service.
+	Admins map[string]bool
+}
+
+// Identity returns the identity of the caller in ctx. A known bearer
+// token takes precedence over the client certificate.
+func (a *Authorizer) Identity(ctx context.Context) (string, error) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, v := range md["authorization"] {
+			if !strings.HasPrefix(v, "Bearer ") {
+				continue
+			}
+
+			if id, ok := a.Tokens[strings.TrimPrefix(v, "Bearer ")]; ok {
+				return id, nil
+			}
+		}
+	}
+
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			chains := info.State.VerifiedChains
+			if len(chains) > 0 && len(chains[0]) > 0 && chains[0][0].Subject.CommonName != "" {
+				return chains[0][0].Subject.CommonName, nil
+			}
+		}
+	}
+
+	return "", ErrNoIdentity
+}
+
+// Authorize returns nil if the caller in ctx may request a certificate
+// for host.
+func (a *Authorizer) Authorize(ctx context.Context, host string) error {
+	id, err := a.Identity(ctx)
+	if err != nil {
+		return err
+	}
+
+	rules, ok := a.Clients[id]
+	if !ok || !rules.Allowed(host) {
+		return fmt.Errorf("achmed: client %q may not request %q", id, host)
+	}
+
+	return nil
+}
+
+// AuthorizeAdmin returns nil if the caller in ctx may use the Admin
+// service.
+func (a *Authorizer) AuthorizeAdmin(ctx context.Context) error {
+	id, err := a.Identity(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !a.Admins[id] {
+		return fmt.Errorf("achmed: client %q is not an admin", id)
+	}
+
+	return nil
+}
+
+// ParseAuthorizer reads an Authorizer from r. Blank lines and lines
+// starting with "#" are ignored, all other lines are one of
+//
+//	client <identity> <pattern>...
+//	token <token> <identity>
+//	admin <identity>...
+//
+// A pattern is a host name, or a domain with a leading "." that allows
+// the domain and all its subdomains.
+func ParseAuthorizer(r io.Reader) (*Authorizer, error) {
+	a := &Authorizer{
+		Tokens:  make(map[string]string),
+		Clients: make(map[string]*HostRules),
+		Admins:  make(map[string]bool),
+	}
+
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		switch {
+		case fields[0] == "client" && len(fields) >= 3:
+			rules, ok := a.Clients[fields[1]]
+			if !ok {
+				rules = &HostRules{}
+				a.Clients[fields[1]] = rules
+			}
+
+			for _, p := range fields[2:] {
+				if strings.HasPrefix(p, ".") {
+					rules.Suffixes = append(rules.Suffixes, p[1:])
+				} else {
+					rules.Exact = append(rules.Exact, p)
+				}
+			}
+		case fields[0] == "token" && len(fields) == 3:
+			a.Tokens[fields[1]] = fields[2]
+		case fields[0] == "admin" && len(fields) >= 2:
+			for _, id := range fields[1:] {
+				a.Admins[id] = true
+			}
+		default:
+			return nil, fmt.Errorf("achmed: line %d: invalid client rule %q", n, s.Text())
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+const testACL = `
+# frontends
+client web example.com .example.org
+client web www.example.com
+token s3cret web
+
+# operators
+token 4dm1n ops
+admin ops
+`
+
+func TestParseAuthorizer(t *testing.T) {
+	auth, err := ParseAuthorizer(strings.NewReader(testACL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if auth.Tokens["s3cret"] != "web" {
+		t.Fatalf("expected token for web, got %v", auth.Tokens)
+	}
+
+	rules := auth.Clients["web"]
+	if rules == nil || len(rules.Exact) != 2 || len(rules.Suffixes) != 1 {
+		t.Fatalf("expected two names and one domain for web, got %+v", rules)
+	}
+
+	if !auth.Admins["ops"] || auth.Admins["web"] {
+		t.Fatalf("expected ops to be the only admin, got %v", auth.Admins)
+	}
+
+	if _, err := ParseAuthorizer(strings.NewReader("token s3cret")); err == nil {
+		t.Fatalf("expected error for incomplete rule")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	auth, err := ParseAuthorizer(strings.NewReader(testACL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bearer := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer s3cret"))
+
+	mtls := peer.NewContext(context.Background(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{
+			State: tls.ConnectionState{
+				VerifiedChains: [][]*x509.Certificate{{selfSigned(t, "web").Leaf}},
+			},
+		},
+	})
+
+	tests := []struct {
+		ctx  context.Context
+		host string
+		ok   bool
+	}{
+		{bearer, "example.com", true},
+		{bearer, "www.example.org", true},
+		{bearer, "example.net", false},
+		{mtls, "www.example.com", true},
+		{mtls, "mail.example.com", false},
+		{context.Background(), "example.com", false},
+		{metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer wrong")), "example.com", false},
+	}
+
+	for _, tt := range tests {
+		if err := auth.Authorize(tt.ctx, tt.host); (err == nil) != tt.ok {
+			t.Errorf("Authorize(%q) = %v, want ok %v", tt.host, err, tt.ok)
+		}
+	}
+}
+
+func TestAuthorizeAdmin(t *testing.T) {
+	auth, err := ParseAuthorizer(strings.NewReader(testACL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for token, ok := range map[string]bool{"4dm1n": true, "s3cret": false, "wrong": false} {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+		if err := auth.AuthorizeAdmin(ctx); (err == nil) != ok {
+			t.Errorf("AuthorizeAdmin(%q) = %v, want ok %v", token, err, ok)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"fmt"
+)
+
+// Bundle is a named set of DNS names sharing one certificate, e.g. the
+// apex, www and api names of a domain.
+type Bundle struct {
+	// Name identifies the bundle. Its certificates are cached under
+	// "<name>+bundle".
+	Name string
+
+	// Names are the DNS names the certificate is issued for. The first
+	// one is the subject common name.
+	Names []string
+}
+
+// WithBundles makes the server issue one certificate per bundle, and
+// serve it for every name of the bundle.
+func WithBundles(bundles ...Bundle) Option {
+	return func(a *AchmedServer) {
+		a.bundleList = append(a.bundleList, bundles...)
+	}
+}
+
+// bundleIndex maps each name of bundles to its bundle.
+func bundleIndex(bundles []Bundle) (map[string]*Bundle, error) {
+	index := make(map[string]*Bundle)
+
+	for n := range bundles {
+		b := &bundles[n]
+		if b.Name == "" || len(b.Names) == 0 {
+			return nil, fmt.Errorf("achmed: bundle %q needs a name and at least one DNS name", b.Name)
+		}
+
+		for _, name := range b.Names {
+			name = normalizeHost(name)
+			if other, ok := index[name]; ok {
+				return nil, fmt.Errorf("achmed: %q is in bundles %q and %q", name, other.Name, b.Name)
+			}
+			index[name] = b
+		}
+	}
+
+	return index, nil
+}
+
+func (b *Bundle) key(useRSA bool) string {
+	return certKey(b.Name+"+bundle", useRSA)
+}
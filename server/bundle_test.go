@@ -0,0 +1,81 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestBundleIndex(t *testing.T) {
+	bundles := []Bundle{
+		{Name: "example", Names: []string{"example.com", "WWW.example.com", "api.example.com"}},
+		{Name: "other", Names: []string{"example.org"}},
+	}
+
+	index, err := bundleIndex(bundles)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b := index["www.example.com"]; b == nil || b.Name != "example" {
+		t.Fatalf("expected www.example.com in bundle example, got %+v", b)
+	}
+
+	if b := index["example.org"]; b == nil || b.key(true) != "other+bundle+rsa" {
+		t.Fatalf("expected example.org in bundle other, got %+v", b)
+	}
+
+	bundles = append(bundles, Bundle{Name: "dup", Names: []string{"example.org"}})
+	if _, err := bundleIndex(bundles); err == nil {
+		t.Fatalf("expected error for name in two bundles")
+	}
+
+	if _, err := bundleIndex([]Bundle{{Name: "empty"}}); err == nil {
+		t.Fatalf("expected error for empty bundle")
+	}
+}
+
+func TestBundleAuthorization(t *testing.T) {
+	auth, err := ParseAuthorizer(strings.NewReader(`
+client www www.example.com
+client web .example.com
+token www www
+token web web
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := New("", nil, &acme.Client{Key: key}, nil, WithAuthorizer(auth),
+		WithBundles(Bundle{Name: "example", Names: []string{"example.com", "www.example.com", "api.example.com"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caller := func(token string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+	}
+
+	// www may not get the key of the certificate for api.example.com.
+	if _, _, err := a.certificateFor(caller("www"), &tls.ClientHelloInfo{ServerName: "www.example.com"}); grpc.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected bundle to be denied, got %v", err)
+	}
+
+	if ck, names, err := a.certificateFor(caller("web"), &tls.ClientHelloInfo{ServerName: "www.example.com"}); err != nil || ck != "example+bundle+rsa" || len(names) != 3 {
+		t.Fatalf("expected bundle certificate, got %q, %v, %v", ck, names, err)
+	}
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/offblast/achmed/proto"
+)
+
+// certificateToProto encodes cert for the wire, both as a PEM blob for
+// older clients and as structured fields.
+func certificateToProto(cert *tls.Certificate) (*proto.Certificate, error) {
+	if len(cert.Certificate) == 0 {
+		return nil, fmt.Errorf("achmed: empty certificate chain")
+	}
+
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	pemdata, err := certificatePEM(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &proto.Certificate{
+		Pem:         pemdata,
+		Chain:       cert.Certificate,
+		Privatekey:  pkcs8,
+		Notbefore:   leaf.NotBefore.Unix(),
+		Notafter:    leaf.NotAfter.Unix(),
+		Issuer:      leaf.Issuer.CommonName,
+		Serial:      fmt.Sprintf("%x", leaf.SerialNumber),
+		Ocspstaple:  cert.OCSPStaple,
+		Fingerprint: fingerprint(leaf.Raw),
+	}, nil
+}
+
+// certificatePEM encodes the private key and chain of cert as PEM blocks,
+// in the format autocert.Manager keeps certificates in its cache.
+func certificatePEM(cert *tls.Certificate) ([]byte, error) {
+	var pembuf bytes.Buffer
+
+	var pkey *pem.Block
+
+	switch t := cert.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		pkey = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(t)}
+	case *ecdsa.PrivateKey:
+		pkeyb, err := x509.MarshalECPrivateKey(t)
+		if err != nil {
+			return nil, err
+		}
+
+		pkey = &pem.Block{Type: "EC PRIVATE KEY", Bytes: pkeyb}
+	default:
+		return nil, x509.ErrUnsupportedAlgorithm
+	}
+
+	if err := pem.Encode(&pembuf, pkey); err != nil {
+		return nil, err
+	}
+
+	for _, b := range cert.Certificate {
+		pb := &pem.Block{Type: "CERTIFICATE", Bytes: b}
+		if err := pem.Encode(&pembuf, pb); err != nil {
+			return nil, err
+		}
+	}
+
+	return pembuf.Bytes(), nil
+}
+
+// parseCertificatePEM parses a certificate encoded by certificatePEM.
+func parseCertificatePEM(data []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+
+	return &cert, nil
+}
+
+// fingerprint returns the hex encoded SHA-256 hash of a DER certificate.
+func fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// encodedCerts keeps the wire encoding of the certificate last served for
+// each certificate key, so the private key and chain are not encoded again
+// on every request. An entry is replaced once a different leaf, e.g. a
+// renewed certificate, is served for its key, and dropped once its key is
+// revoked or its certificate expired.
+//
+// The cached messages are shared between responses and must not be modified.
+type encodedCerts struct {
+	mu sync.RWMutex
+	m  map[string]encodedCert
+}
+
+type encodedCert struct {
+	// leaf is the DER encoded leaf the message was encoded from.
+	leaf []byte
+	msg  *proto.Certificate
+
+	// notAfter is when the leaf expires, zero if unknown.
+	notAfter time.Time
+}
+
+func newEncodedCerts() *encodedCerts {
+	return &encodedCerts{m: make(map[string]encodedCert)}
+}
+
+// get returns the encoding of cert served under key.
+func (e *encodedCerts) get(key string, cert *tls.Certificate) (*proto.Certificate, error) {
+	if len(cert.Certificate) == 0 {
+		return nil, fmt.Errorf("achmed: empty certificate chain")
+	}
+
+	leaf := cert.Certificate[0]
+
+	e.mu.RLock()
+	ec, ok := e.m[key]
+	e.mu.RUnlock()
+
+	if ok && bytes.Equal(ec.leaf, leaf) {
+		return ec.msg, nil
+	}
+
+	msg, err := certificateToProto(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	ec = encodedCert{leaf: leaf, msg: msg}
+	if cert.Leaf != nil {
+		ec.notAfter = cert.Leaf.NotAfter
+	}
+
+	now := time.Now()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// new certificates are rare, so expired ones are dropped here.
+	for k, old := range e.m {
+		if !old.notAfter.IsZero() && now.After(old.notAfter) {
+			delete(e.m, k)
+		}
+	}
+	e.m[key] = ec
+
+	return msg, nil
+}
+
+// delete drops the encoding served under key.
+func (e *encodedCerts) delete(key string) {
+	e.mu.Lock()
+	delete(e.m, key)
+	e.mu.Unlock()
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// selfSigned returns a self-signed ECDSA certificate for names, valid for
+// 90 days.
+func selfSigned(t *testing.T, names ...string) *tls.Certificate {
+	return selfSignedUntil(t, time.Now().Add(90*24*time.Hour), names...)
+}
+
+// selfSignedUntil returns a self-signed ECDSA certificate for names,
+// expiring at notAfter.
+func selfSignedUntil(t *testing.T, notAfter time.Time, names ...string) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: names[0]},
+		Issuer:       pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+}
+
+func TestCertificateToProto(t *testing.T) {
+	cert := selfSigned(t, "example.com")
+
+	msg, err := certificateToProto(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(msg.Pem) == 0 || len(msg.Privatekey) == 0 || len(msg.Chain) != 1 {
+		t.Fatalf("expected pem, private key and chain, got %+v", msg)
+	}
+
+	if msg.Serial != "2a" {
+		t.Fatalf("expected serial %q, got %q", "2a", msg.Serial)
+	}
+
+	if msg.Notafter != cert.Leaf.NotAfter.Unix() {
+		t.Fatalf("expected notafter %d, got %d", cert.Leaf.NotAfter.Unix(), msg.Notafter)
+	}
+
+	if _, err := x509.ParsePKCS8PrivateKey(msg.Privatekey); err != nil {
+		t.Fatalf("expected PKCS#8 private key, got %q", err)
+	}
+}
+
+func TestEncodedCerts(t *testing.T) {
+	e := newEncodedCerts()
+	cert := selfSigned(t, "example.com")
+
+	first, err := e.get("example.com", cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := e.get("example.com", cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first != second {
+		t.Fatalf("expected the encoding to be reused")
+	}
+
+	renewed, err := e.get("example.com", selfSigned(t, "example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if renewed == first || renewed.Fingerprint == first.Fingerprint {
+		t.Fatalf("expected a new encoding for a renewed certificate")
+	}
+
+	if _, err := e.get("expired.example.com", selfSignedUntil(t, time.Now().Add(-time.Minute), "expired.example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.get("example.org", selfSigned(t, "example.org")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := e.m["expired.example.com"]; ok {
+		t.Fatalf("expected expired encoding to be dropped")
+	}
+
+	e.delete("example.com")
+	if _, ok := e.m["example.com"]; ok || len(e.m) != 1 {
+		t.Fatalf("expected revoked encoding to be dropped, got %d left", len(e.m))
+	}
+}
+
+func TestCertificatePEM(t *testing.T) {
+	cert := selfSigned(t, "example.com")
+
+	data, err := certificatePEM(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := parseCertificatePEM(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed.Leaf == nil || !parsed.Leaf.Equal(cert.Leaf) {
+		t.Fatalf("expected the same leaf after a round trip")
+	}
+}
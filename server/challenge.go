@@ -0,0 +1,37 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// challengePath is where HTTP-01 challenge responses are served.
+const challengePath = "/.well-known/acme-challenge/"
+
+// challengeWriter is an http.ResponseWriter that keeps the response in
+// memory, used to run autocert's HTTP-01 handler on behalf of a client.
+type challengeWriter struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (w *challengeWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = make(http.Header)
+	}
+	return w.header
+}
+
+func (w *challengeWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+func (w *challengeWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
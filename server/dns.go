@@ -0,0 +1,289 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+const (
+	// defaultDNSTTL is the TTL of challenge records when none is set.
+	defaultDNSTTL = 60
+
+	// defaultDNSTimeout bounds each DNS exchange when no timeout is set.
+	defaultDNSTimeout = 10 * time.Second
+
+	// defaultPropagationTimeout bounds the wait for challenge records to
+	// be served by all nameservers when no timeout is set.
+	defaultPropagationTimeout = 2 * time.Minute
+
+	// propagationInterval is how often nameservers are asked for a
+	// challenge record that they did not serve yet.
+	propagationInterval = 2 * time.Second
+)
+
+// DNSProvider publishes the TXT records of DNS-01 challenges.
+type DNSProvider interface {
+	// Present adds a TXT record with value at fqdn, e.g.
+	// "_acme-challenge.example.com.". It should return once the record
+	// is visible to the ACME server.
+	Present(ctx context.Context, fqdn, value string) error
+
+	// CleanUp removes the TXT record added by Present.
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// RFC2136Provider is a DNSProvider that adds and removes records with
+// dynamic updates, as described in RFC 2136, optionally signed with TSIG.
+type RFC2136Provider struct {
+	// Nameserver is the host:port of the primary nameserver of the zone.
+	Nameserver string
+
+	// Zone is the zone to update, e.g. "example.com.". If empty, it is
+	// looked up from the SOA records served by Nameserver.
+	Zone string
+
+	// TTL is the TTL of challenge records. If zero, 60 seconds are used.
+	TTL uint32
+
+	// TSIGKey and TSIGSecret, base64 encoded, sign updates if set.
+	// TSIGAlgorithm defaults to HMAC-SHA256.
+	TSIGKey       string
+	TSIGSecret    string
+	TSIGAlgorithm string
+
+	// Timeout bounds each DNS exchange. If zero, 10 seconds are used.
+	Timeout time.Duration
+
+	// Nameservers are the host:port of the nameservers Present waits
+	// for to serve a record. If empty, the nameservers in the NS records
+	// of the zone are asked, on port 53.
+	Nameservers []string
+
+	// PropagationTimeout bounds how long Present waits for a record to
+	// be served. If zero, 2 minutes are used.
+	PropagationTimeout time.Duration
+}
+
+// Present adds the TXT record, and returns once all the nameservers of
+// the zone serve it.
+func (p *RFC2136Provider) Present(ctx context.Context, fqdn, value string) error {
+	if err := p.update(ctx, fqdn, value, true); err != nil {
+		return err
+	}
+
+	return p.waitPropagation(ctx, dns.Fqdn(fqdn), value)
+}
+
+func (p *RFC2136Provider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, value, false)
+}
+
+func (p *RFC2136Provider) update(ctx context.Context, fqdn, value string, insert bool) error {
+	fqdn = dns.Fqdn(fqdn)
+
+	zone, err := p.zone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+
+	ttl := p.TTL
+	if ttl == 0 {
+		ttl = defaultDNSTTL
+	}
+
+	rr := &dns.TXT{
+		Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl},
+		Txt: []string{value},
+	}
+
+	m := new(dns.Msg)
+	m.SetUpdate(dns.Fqdn(zone))
+	if insert {
+		m.Insert([]dns.RR{rr})
+	} else {
+		m.Remove([]dns.RR{rr})
+	}
+
+	if p.TSIGKey != "" {
+		alg := p.TSIGAlgorithm
+		if alg == "" {
+			alg = dns.HmacSHA256
+		}
+		m.SetTsig(dns.Fqdn(p.TSIGKey), dns.Fqdn(alg), 300, time.Now().Unix())
+	}
+
+	resp, err := p.exchange(ctx, m, p.Nameserver)
+	if err != nil {
+		return err
+	}
+
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("achmed: DNS update of %q failed: %s", fqdn, dns.RcodeToString[resp.Rcode])
+	}
+
+	return nil
+}
+
+// zone returns p.Zone, or else the zone fqdn belongs to.
+func (p *RFC2136Provider) zone(ctx context.Context, fqdn string) (string, error) {
+	if p.Zone != "" {
+		return p.Zone, nil
+	}
+
+	return p.findZone(ctx, fqdn)
+}
+
+// findZone returns the zone fqdn belongs to, from the SOA record the
+// nameserver returns either as answer or as authority.
+func (p *RFC2136Provider) findZone(ctx context.Context, fqdn string) (string, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(fqdn, dns.TypeSOA)
+
+	resp, err := p.exchange(ctx, m, p.Nameserver)
+	if err != nil {
+		return "", err
+	}
+
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns} {
+		for _, rr := range rrs {
+			if soa, ok := rr.(*dns.SOA); ok && dns.IsSubDomain(soa.Hdr.Name, fqdn) {
+				return strings.ToLower(soa.Hdr.Name), nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("achmed: no zone found for %q", fqdn)
+}
+
+// waitPropagation asks the nameservers until all of them serve the TXT
+// record with value at fqdn.
+func (p *RFC2136Provider) waitPropagation(ctx context.Context, fqdn, value string) error {
+	timeout := p.PropagationTimeout
+	if timeout <= 0 {
+		timeout = defaultPropagationTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	pending := p.Nameservers
+	if len(pending) == 0 {
+		var err error
+		if pending, err = p.authoritative(ctx, fqdn); err != nil {
+			return err
+		}
+	}
+
+	for {
+		var left []string
+		for _, ns := range pending {
+			if !p.serves(ctx, ns, fqdn, value) {
+				left = append(left, ns)
+			}
+		}
+
+		if pending = left; len(pending) == 0 {
+			return nil
+		}
+
+		select {
+		case <-time.After(propagationInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("achmed: TXT record %q not served by %v: %v", fqdn, pending, ctx.Err())
+		}
+	}
+}
+
+// authoritative returns the addresses of the nameservers of the zone
+// fqdn belongs to, from its NS records.
+func (p *RFC2136Provider) authoritative(ctx context.Context, fqdn string) ([]string, error) {
+	zone, err := p.zone(ctx, fqdn)
+	if err != nil {
+		return nil, err
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(zone), dns.TypeNS)
+
+	resp, err := p.exchange(ctx, m, p.Nameserver)
+	if err != nil {
+		return nil, err
+	}
+
+	// nameservers within the zone come with glue records.
+	glue := make(map[string][]string)
+	for _, rr := range resp.Extra {
+		switch rr := rr.(type) {
+		case *dns.A:
+			glue[strings.ToLower(rr.Hdr.Name)] = append(glue[strings.ToLower(rr.Hdr.Name)], rr.A.String())
+		case *dns.AAAA:
+			glue[strings.ToLower(rr.Hdr.Name)] = append(glue[strings.ToLower(rr.Hdr.Name)], rr.AAAA.String())
+		}
+	}
+
+	var addrs []string
+	for _, rr := range resp.Answer {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+
+		hosts := glue[strings.ToLower(ns.Ns)]
+		if len(hosts) == 0 {
+			if hosts, err = net.DefaultResolver.LookupHost(ctx, ns.Ns); err != nil {
+				return nil, fmt.Errorf("achmed: failed to look up nameserver %q: %v", ns.Ns, err)
+			}
+		}
+
+		for _, host := range hosts {
+			addrs = append(addrs, net.JoinHostPort(host, "53"))
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("achmed: no nameservers found for %q", zone)
+	}
+
+	return addrs, nil
+}
+
+// serves reports whether the nameserver at addr answers with the TXT
+// record with value at fqdn.
+func (p *RFC2136Provider) serves(ctx context.Context, addr, fqdn, value string) bool {
+	m := new(dns.Msg)
+	m.SetQuestion(fqdn, dns.TypeTXT)
+	m.RecursionDesired = false
+
+	resp, err := p.exchange(ctx, m, addr)
+	if err != nil {
+		return false
+	}
+
+	for _, rr := range resp.Answer {
+		if txt, ok := rr.(*dns.TXT); ok && strings.Join(txt.Txt, "") == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *RFC2136Provider) exchange(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, error) {
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = defaultDNSTimeout
+	}
+
+	c := &dns.Client{Timeout: timeout}
+	if p.TSIGKey != "" {
+		c.TsigSecret = map[string]string{dns.Fqdn(p.TSIGKey): p.TSIGSecret}
+	}
+
+	resp, _, err := c.ExchangeContext(ctx, m, addr)
+	return resp, err
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// testZone is a DNS server for example.com. accepting dynamic updates of
+// TXT records signed with the "achmed." TSIG key. Its nameserver is
+// ns.example.com. at 127.0.0.1.
+type testZone struct {
+	mu      sync.Mutex
+	txt     map[string][]string
+	queries int
+}
+
+const testTSIGSecret = "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0"
+
+func (z *testZone) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	soa := &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+		Ns:     "ns.example.com.",
+		Mbox:   "hostmaster.example.com.",
+		Serial: 1,
+	}
+
+	switch r.Opcode {
+	case dns.OpcodeQuery:
+		q := r.Question[0]
+
+		z.mu.Lock()
+		z.queries++
+		for _, v := range z.txt[q.Name] {
+			if q.Qtype == dns.TypeTXT {
+				m.Answer = append(m.Answer, &dns.TXT{
+					Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+					Txt: []string{v},
+				})
+			}
+		}
+		z.mu.Unlock()
+
+		switch {
+		case len(m.Answer) > 0:
+		case q.Name == "example.com." && q.Qtype == dns.TypeNS:
+			m.Answer = []dns.RR{&dns.NS{
+				Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60},
+				Ns:  "ns.example.com.",
+			}}
+			m.Extra = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: "ns.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("127.0.0.1"),
+			}}
+		case q.Name == "example.com.":
+			m.Answer = []dns.RR{soa}
+		default:
+			m.Ns = []dns.RR{soa}
+		}
+	case dns.OpcodeUpdate:
+		if r.IsTsig() == nil || w.TsigStatus() != nil || r.Question[0].Name != "example.com." {
+			m.Rcode = dns.RcodeRefused
+			break
+		}
+
+		z.mu.Lock()
+		for _, rr := range r.Ns {
+			txt, ok := rr.(*dns.TXT)
+			if !ok {
+				continue
+			}
+
+			name := txt.Hdr.Name
+			if txt.Hdr.Class == dns.ClassNONE {
+				var kept []string
+				for _, v := range z.txt[name] {
+					if v != txt.Txt[0] {
+						kept = append(kept, v)
+					}
+				}
+				z.txt[name] = kept
+			} else {
+				z.txt[name] = append(z.txt[name], txt.Txt[0])
+			}
+		}
+		z.mu.Unlock()
+	}
+
+	if r.IsTsig() != nil {
+		m.SetTsig(r.IsTsig().Hdr.Name, dns.HmacSHA256, 300, int64(r.IsTsig().TimeSigned))
+	}
+
+	w.WriteMsg(m)
+}
+
+func startTestZone(t *testing.T) (*testZone, string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	z := &testZone{txt: make(map[string][]string)}
+
+	started := make(chan struct{})
+	srv := &dns.Server{
+		PacketConn:        pc,
+		Handler:           z,
+		TsigSecret:        map[string]string{"achmed.": testTSIGSecret},
+		NotifyStartedFunc: func() { close(started) },
+		// the default rejects updates.
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+	}
+
+	go srv.ActivateAndServe()
+	<-started
+
+	return z, pc.LocalAddr().String(), func() { srv.Shutdown() }
+}
+
+func TestRFC2136Provider(t *testing.T) {
+	z, addr, stop := startTestZone(t)
+	defer stop()
+
+	p := &RFC2136Provider{
+		Nameserver:  addr,
+		TSIGKey:     "achmed",
+		TSIGSecret:  testTSIGSecret,
+		Nameservers: []string{addr},
+	}
+
+	ctx := context.Background()
+	fqdn := "_acme-challenge.www.example.com."
+
+	if zone, err := p.findZone(ctx, fqdn); err != nil || zone != "example.com." {
+		t.Fatalf("expected zone example.com., got %q, %v", zone, err)
+	}
+
+	if err := p.Present(ctx, fqdn, "token"); err != nil {
+		t.Fatal(err)
+	}
+
+	z.mu.Lock()
+	got := z.txt[fqdn]
+	z.mu.Unlock()
+	if len(got) != 1 || got[0] != "token" {
+		t.Fatalf("expected TXT record %q, got %v", "token", got)
+	}
+
+	if err := p.CleanUp(ctx, fqdn, "token"); err != nil {
+		t.Fatal(err)
+	}
+
+	z.mu.Lock()
+	got = z.txt[fqdn]
+	z.mu.Unlock()
+	if len(got) != 0 {
+		t.Fatalf("expected TXT record to be removed, got %v", got)
+	}
+
+	unsigned := &RFC2136Provider{Nameserver: addr, Zone: "example.com.", Nameservers: []string{addr}}
+	if err := unsigned.Present(ctx, fqdn, "token"); err == nil {
+		t.Fatalf("expected unsigned update to be refused")
+	}
+}
+
+func TestRFC2136Propagation(t *testing.T) {
+	primary, addr, stop := startTestZone(t)
+	defer stop()
+
+	secondary, secondaryAddr, stop := startTestZone(t)
+	defer stop()
+
+	p := &RFC2136Provider{
+		Nameserver:  addr,
+		TSIGKey:     "achmed",
+		TSIGSecret:  testTSIGSecret,
+		Nameservers: []string{addr, secondaryAddr},
+	}
+
+	ctx := context.Background()
+	fqdn := "_acme-challenge.www.example.com."
+
+	if addrs, err := p.authoritative(ctx, fqdn); err != nil || len(addrs) != 1 || addrs[0] != "127.0.0.1:53" {
+		t.Fatalf("expected the nameserver of the zone, got %v, %v", addrs, err)
+	}
+
+	// the secondary only serves the record once it was asked for it.
+	go func() {
+		for {
+			secondary.mu.Lock()
+			if secondary.queries > 0 {
+				primary.mu.Lock()
+				secondary.txt[fqdn] = primary.txt[fqdn]
+				primary.mu.Unlock()
+				secondary.mu.Unlock()
+				return
+			}
+			secondary.mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	if err := p.Present(ctx, fqdn, "token"); err != nil {
+		t.Fatal(err)
+	}
+
+	secondary.mu.Lock()
+	queries := secondary.queries
+	secondary.mu.Unlock()
+	if queries < 2 {
+		t.Fatalf("expected Present to wait for the secondary, got %d queries", queries)
+	}
+
+	// records that are never served time out.
+	p.PropagationTimeout = 100 * time.Millisecond
+	if err := p.Present(ctx, fqdn, "other"); err == nil {
+		t.Fatalf("expected Present to time out")
+	}
+}
@@ -0,0 +1,687 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+)
+
+const (
+	// defaultRenewBefore is when certificates are renewed if the manager
+	// has no RenewBefore set, like autocert does.
+	defaultRenewBefore = 30 * 24 * time.Hour
+
+	// issueTimeout bounds obtaining one certificate.
+	issueTimeout = 5 * time.Minute
+)
+
+// WithDNSProvider makes the server obtain certificates with DNS-01
+// challenges published through p, instead of TLS-ALPN-01 and HTTP-01.
+// This allows certificates for hosts that are not publicly reachable.
+func WithDNSProvider(p DNSProvider) Option {
+	return func(a *AchmedServer) {
+		a.dns = p
+	}
+}
+
+// issuer obtains certificates for one or more names. It answers DNS-01
+// challenges if it has a DNSProvider, else TLS-ALPN-01 or HTTP-01
+// challenges.
+//
+// It uses the client and cache of an autocert.Manager, and keeps
+// certificates in the same cache format under the same keys, so either
+// can serve the certificates of the other. Challenge tokens and
+// certificates are cached like autocert does, so that other replicas can
+// answer challenges too.
+type issuer struct {
+	m   *autocert.Manager
+	dns DNSProvider
+
+	// issuances, if set, keeps issuance below weekly limits.
+	issuances *issuanceLog
+
+	// locker, if set, serializes orders across replicas.
+	locker Locker
+
+	// renewals records the last renewal attempt of each certificate.
+	renewals *renewalLog
+
+	// changed, if set, is called with the key of every new certificate.
+	changed func(key string)
+
+	// limit, if set, is asked before every order.
+	limit func(names []string) error
+
+	// regMu guards registering the ACME account once.
+	regMu      sync.Mutex
+	registered bool
+
+	mu       sync.Mutex
+	certs    map[string]*tls.Certificate
+	renewing map[string]bool
+
+	// reloaded is when certificates were last reloaded from the cache, to
+	// pick up renewals by other replicas.
+	reloaded map[string]time.Time
+
+	// tokens holds the key authorizations of pending HTTP-01 challenges,
+	// alpnCerts the certificates of pending TLS-ALPN-01 challenges.
+	tokens    map[string][]byte
+	alpnCerts map[string]*tls.Certificate
+}
+
+func newIssuer(m *autocert.Manager, p DNSProvider, issuances *issuanceLog) (*issuer, error) {
+	if m.Client == nil || m.Client.Key == nil {
+		return nil, errors.New("achmed: issuance needs an ACME client with a key")
+	}
+
+	return &issuer{
+		m:         m,
+		dns:       p,
+		issuances: issuances,
+		renewals:  newRenewalLog(m.Cache),
+		certs:     make(map[string]*tls.Certificate),
+		renewing:  make(map[string]bool),
+		reloaded:  make(map[string]time.Time),
+		tokens:    make(map[string][]byte),
+		alpnCerts: make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// certKey returns the cache key of the certificate for name, as used by
+// autocert.
+func certKey(name string, useRSA bool) string {
+	if useRSA {
+		return name + "+rsa"
+	}
+	return name
+}
+
+// GetCertificate returns the certificate stored under key, issuing one
+// for names if there is none. Names may include wildcards, which need
+// DNS-01. Certificates due for renewal are returned while they are
+// renewed in the background.
+//
+// Callers are expected to have checked the host policy.
+func (i *issuer) GetCertificate(key string, names []string, useRSA bool) (*tls.Certificate, error) {
+	if len(names) == 0 {
+		return nil, errors.New("achmed: missing server name")
+	}
+
+	names = normalizedNames(names)
+
+	ctx, cancel := context.WithTimeout(context.Background(), issueTimeout)
+	defer cancel()
+
+	if cert := i.cached(ctx, key, names); cert != nil {
+		if i.due(cert) {
+			i.renew(key, names, useRSA, cert)
+		}
+		return cert, nil
+	}
+
+	if err := i.issuances.check(ctx, names); err != nil {
+		return nil, err
+	}
+
+	unlock, cert, err := i.lock(ctx, key, names, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if cert != nil {
+		return cert, nil
+	}
+
+	return i.obtain(ctx, key, names, useRSA)
+}
+
+func (i *issuer) renewBefore() time.Duration {
+	if i.m.RenewBefore > 0 {
+		return i.m.RenewBefore
+	}
+	return defaultRenewBefore
+}
+
+// due reports whether cert is due for renewal.
+func (i *issuer) due(cert *tls.Certificate) bool {
+	return time.Now().After(cert.Leaf.NotAfter.Add(-i.renewBefore()))
+}
+
+// coversNames reports whether leaf was issued for all of names, which are
+// compared literally, so that a wildcard only matches the same wildcard.
+func coversNames(leaf *x509.Certificate, names []string) bool {
+	for _, n := range names {
+		found := false
+		for _, dn := range leaf.DNSNames {
+			if normalizeHost(dn) == n {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// cached returns the certificate stored under key if it is valid for names.
+//
+// Certificates are reloaded from the cache once a minute, in case they
+// were renewed elsewhere. Certificates missing from the cache are only
+// dropped if another replica marked them revoked.
+func (i *issuer) cached(ctx context.Context, key string, names []string) *tls.Certificate {
+	i.mu.Lock()
+	cert := i.certs[key]
+	reload := cert == nil || time.Since(i.reloaded[key]) > time.Minute
+	if reload && cert != nil {
+		i.reloaded[key] = time.Now()
+	}
+	i.mu.Unlock()
+
+	if reload && i.m.Cache != nil {
+		c, err := i.load(ctx, key)
+		switch {
+		case err == autocert.ErrCacheMiss && cert != nil:
+			// a lost cache entry doesn't make the certificate invalid.
+			if marker := loadReplacedMarker(ctx, i.m.Cache, key); marker != nil && marker.Serial == fmt.Sprintf("%x", cert.Leaf.SerialNumber) {
+				i.forget(key)
+				return nil
+			}
+		case c != nil && (cert == nil || !c.Leaf.NotBefore.Before(cert.Leaf.NotBefore)):
+			// never go back to an older certificate.
+			cert = c
+		}
+	}
+
+	if cert == nil || time.Now().After(cert.Leaf.NotAfter) || !coversNames(cert.Leaf, names) {
+		return nil
+	}
+
+	i.mu.Lock()
+	i.certs[key] = cert
+	i.mu.Unlock()
+
+	return cert
+}
+
+// load returns the certificate stored under key in the cache, or
+// autocert.ErrCacheMiss if there is none.
+func (i *issuer) load(ctx context.Context, key string) (*tls.Certificate, error) {
+	data, err := i.m.Cache.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := parseCertificatePEM(data)
+	if err != nil {
+		log.Printf("achmed: invalid certificate %q in cache: %v", key, err)
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+// certificate returns the certificate stored under key from memory.
+func (i *issuer) certificate(key string) *tls.Certificate {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.certs[key]
+}
+
+// forget drops the certificate stored under key from memory.
+func (i *issuer) forget(key string) {
+	i.mu.Lock()
+	delete(i.certs, key)
+	delete(i.reloaded, key)
+	i.mu.Unlock()
+}
+
+// renew obtains a new certificate for names in the background, unless
+// that is already happening.
+func (i *issuer) renew(key string, names []string, useRSA bool, old *tls.Certificate) {
+	i.mu.Lock()
+	renewing := i.renewing[key]
+	i.mu.Unlock()
+
+	if renewing {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), issueTimeout)
+		defer cancel()
+
+		if err := i.renewNow(ctx, key, names, useRSA, old); err != nil {
+			log.Printf("achmed: failed to renew certificate %q: %v", key, err)
+		}
+	}()
+}
+
+// renewNow replaces old, stored under key, with a new certificate for
+// names, unless that is already happening. With a locker, it holds the
+// certificate's lock, and does nothing if another replica replaced old in
+// the meantime. First orders are locked the same way.
+func (i *issuer) renewNow(ctx context.Context, key string, names []string, useRSA bool, old *tls.Certificate) error {
+	i.mu.Lock()
+	if i.renewing[key] {
+		i.mu.Unlock()
+		return nil
+	}
+	i.renewing[key] = true
+	i.mu.Unlock()
+
+	defer func() {
+		i.mu.Lock()
+		delete(i.renewing, key)
+		i.mu.Unlock()
+	}()
+
+	unlock, cert, err := i.lock(ctx, key, names, old)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if cert != nil {
+		return nil
+	}
+
+	_, err = i.obtain(ctx, key, names, useRSA)
+	i.renewals.record(context.Background(), key, err)
+	return err
+}
+
+// lock takes the lock of the certificate stored under key, if there is a
+// locker. Holding it, it returns the certificate for names another
+// replica stored in the meantime, if that replaces old.
+func (i *issuer) lock(ctx context.Context, key string, names []string, old *tls.Certificate) (func(), *tls.Certificate, error) {
+	if i.locker == nil {
+		return unlocked, nil, nil
+	}
+
+	unlock, err := i.locker.Lock(ctx, "cert/"+key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if i.m.Cache != nil {
+		if cert, err := i.load(ctx, key); err == nil && replaced(cert, old) && coversNames(cert.Leaf, names) {
+			i.mu.Lock()
+			i.certs[key] = cert
+			i.mu.Unlock()
+			return unlock, cert, nil
+		}
+	}
+
+	return unlock, nil, nil
+}
+
+// replaced reports whether cert is a valid successor of old.
+func replaced(cert, old *tls.Certificate) bool {
+	if time.Now().After(cert.Leaf.NotAfter) {
+		return false
+	}
+	return old == nil || cert.Leaf.SerialNumber.Cmp(old.Leaf.SerialNumber) != 0
+}
+
+// obtain issues a certificate for names and stores it under key. If it
+// can't be cached, the certificate is kept in memory and returned with
+// the error, so that it isn't ordered again.
+func (i *issuer) obtain(ctx context.Context, key string, names []string, useRSA bool) (*tls.Certificate, error) {
+	if i.limit != nil {
+		if err := i.limit(names); err != nil {
+			return nil, err
+		}
+	}
+
+	cert, err := i.issue(ctx, names, useRSA)
+	if err != nil {
+		return nil, err
+	}
+
+	i.mu.Lock()
+	i.certs[key] = cert
+	i.mu.Unlock()
+
+	if i.m.Cache != nil {
+		var data []byte
+		if data, err = certificatePEM(cert); err == nil {
+			err = i.m.Cache.Put(ctx, key, data)
+		}
+		if err != nil {
+			log.Printf("achmed: failed to cache certificate %q: %v", key, err)
+			err = fmt.Errorf("achmed: failed to cache certificate %q: %v", key, err)
+		}
+	}
+
+	if i.changed != nil {
+		i.changed(key)
+	}
+
+	return cert, err
+}
+
+func (i *issuer) register(ctx context.Context) error {
+	i.regMu.Lock()
+	defer i.regMu.Unlock()
+
+	if i.registered {
+		return nil
+	}
+
+	acct := &acme.Account{}
+	if i.m.Email != "" {
+		acct.Contact = []string{"mailto:" + i.m.Email}
+	}
+
+	_, err := i.m.Client.Register(ctx, acct, acme.AcceptTOS)
+	if err != nil && err != acme.ErrAccountAlreadyExists {
+		return err
+	}
+
+	i.registered = true
+	return nil
+}
+
+// issue orders a certificate for names and answers its challenges.
+func (i *issuer) issue(ctx context.Context, names []string, useRSA bool) (*tls.Certificate, error) {
+	if err := i.register(ctx); err != nil {
+		return nil, err
+	}
+
+	client := i.m.Client
+
+	order, err := i.authorizeOrder(ctx, names)
+	if err != nil {
+		return nil, err
+	}
+
+	var key crypto.Signer
+	if useRSA {
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	} else {
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: names[0]},
+		DNSNames: names,
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: der,
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// authorizeOrder orders a certificate for names, and returns the order
+// once its authorizations are valid. Like autocert, it places a new order
+// with the next challenge type whenever a challenge fails.
+func (i *issuer) authorizeOrder(ctx context.Context, names []string) (*acme.Order, error) {
+	client := i.m.Client
+
+	types := []string{"tls-alpn-01", "http-01"}
+	if i.dns != nil {
+		types = []string{"dns-01"}
+	}
+
+	// a challenge type that failed for one authorization will most likely
+	// fail for the others too.
+	typ := 0
+	var failed error
+
+orders:
+	for typ < len(types) {
+		order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(names...))
+		if err != nil {
+			return nil, err
+		}
+
+		// don't leave pending authorizations behind.
+		defer i.deactivate(order.AuthzURLs)
+
+		switch order.Status {
+		case acme.StatusReady:
+			return order, nil
+		case acme.StatusPending:
+		default:
+			return nil, fmt.Errorf("achmed: invalid status %q of new order %q", order.Status, order.URI)
+		}
+
+		for _, u := range order.AuthzURLs {
+			z, err := client.GetAuthorization(ctx, u)
+			if err != nil {
+				return nil, err
+			}
+
+			if z.Status != acme.StatusPending {
+				continue
+			}
+
+			chal := pickChallenge(types[typ], z.Challenges)
+			for chal == nil && typ+1 < len(types) {
+				typ++
+				chal = pickChallenge(types[typ], z.Challenges)
+			}
+			if chal == nil {
+				return nil, fmt.Errorf("achmed: no %s challenge for %q", strings.Join(types, " or "), z.Identifier.Value)
+			}
+
+			if failed = i.answer(ctx, z, chal); failed != nil {
+				log.Printf("achmed: %s challenge for %q failed: %v", chal.Type, z.Identifier.Value, failed)
+				typ++
+				continue orders
+			}
+		}
+
+		if order, failed = client.WaitOrder(ctx, order.URI); failed == nil {
+			return order, nil
+		}
+		typ++
+	}
+
+	return nil, failed
+}
+
+// pickChallenge returns the challenge of type typ, or nil if there is none.
+func pickChallenge(typ string, chals []*acme.Challenge) *acme.Challenge {
+	for _, c := range chals {
+		if c.Type == typ {
+			return c
+		}
+	}
+	return nil
+}
+
+// answer presents chal, and waits for the ACME server to validate it.
+func (i *issuer) answer(ctx context.Context, z *acme.Authorization, chal *acme.Challenge) error {
+	var cleanup func()
+	var err error
+
+	switch chal.Type {
+	case "dns-01":
+		cleanup, err = i.presentDNS(ctx, z, chal)
+	case "tls-alpn-01":
+		cleanup, err = i.presentTLSALPN(ctx, z, chal)
+	default:
+		cleanup, err = i.presentHTTP(ctx, chal)
+	}
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if _, err := i.m.Client.Accept(ctx, chal); err != nil {
+		return err
+	}
+
+	_, err = i.m.Client.WaitAuthorization(ctx, z.URI)
+	return err
+}
+
+// deactivate relinquishes the authorizations at urls that are still
+// pending, in the background.
+func (i *issuer) deactivate(urls []string) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+
+		for _, u := range urls {
+			if z, err := i.m.Client.GetAuthorization(ctx, u); err == nil && z.Status == acme.StatusPending {
+				i.m.Client.RevokeAuthorization(ctx, u)
+			}
+		}
+	}()
+}
+
+// presentDNS publishes the TXT record of a DNS-01 challenge, and returns
+// a function removing it again.
+func (i *issuer) presentDNS(ctx context.Context, z *acme.Authorization, chal *acme.Challenge) (func(), error) {
+	value, err := i.m.Client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	// wildcard authorizations are for the domain below the wildcard.
+	fqdn := "_acme-challenge." + strings.TrimPrefix(z.Identifier.Value, "*.") + "."
+
+	if err := i.dns.Present(ctx, fqdn, value); err != nil {
+		return nil, err
+	}
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		if err := i.dns.CleanUp(ctx, fqdn, value); err != nil {
+			log.Printf("achmed: failed to clean up %q: %v", fqdn, err)
+		}
+	}, nil
+}
+
+// httpTokenKey returns the cache key autocert keeps HTTP-01 tokens under.
+func httpTokenKey(token string) string {
+	return token + "+http-01"
+}
+
+// presentHTTP makes the key authorization of an HTTP-01 challenge
+// available to GetHTTPChallenge, and returns a function removing it again.
+func (i *issuer) presentHTTP(ctx context.Context, chal *acme.Challenge) (func(), error) {
+	resp, err := i.m.Client.HTTP01ChallengeResponse(chal.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	i.mu.Lock()
+	i.tokens[chal.Token] = []byte(resp)
+	i.mu.Unlock()
+
+	if i.m.Cache != nil {
+		if err := i.m.Cache.Put(ctx, httpTokenKey(chal.Token), []byte(resp)); err != nil {
+			log.Printf("achmed: failed to cache challenge token: %v", err)
+		}
+	}
+
+	return func() {
+		i.mu.Lock()
+		delete(i.tokens, chal.Token)
+		i.mu.Unlock()
+
+		if i.m.Cache != nil {
+			i.m.Cache.Delete(context.Background(), httpTokenKey(chal.Token))
+		}
+	}, nil
+}
+
+// presentTLSALPN makes the certificate of a TLS-ALPN-01 challenge
+// available to GetCertificate, and returns a function removing it again.
+func (i *issuer) presentTLSALPN(ctx context.Context, z *acme.Authorization, chal *acme.Challenge) (func(), error) {
+	name := normalizeHost(z.Identifier.Value)
+
+	cert, err := i.m.Client.TLSALPN01ChallengeCert(chal.Token, name)
+	if err != nil {
+		return nil, err
+	}
+
+	i.mu.Lock()
+	i.alpnCerts[name] = &cert
+	i.mu.Unlock()
+
+	if i.m.Cache != nil {
+		data, err := certificatePEM(&cert)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := i.m.Cache.Put(ctx, name+"+token", data); err != nil {
+			log.Printf("achmed: failed to cache challenge certificate: %v", err)
+		}
+	}
+
+	return func() {
+		i.mu.Lock()
+		delete(i.alpnCerts, name)
+		i.mu.Unlock()
+
+		if i.m.Cache != nil {
+			i.m.Cache.Delete(context.Background(), name+"+token")
+		}
+	}, nil
+}
+
+// challengeCert returns the certificate of a pending TLS-ALPN-01
+// challenge for name.
+func (i *issuer) challengeCert(name string) (*tls.Certificate, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	cert, ok := i.alpnCerts[normalizeHost(name)]
+	return cert, ok
+}
+
+// httpToken returns the key authorization of a pending HTTP-01 challenge.
+func (i *issuer) httpToken(token string) ([]byte, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	resp, ok := i.tokens[token]
+	return resp, ok
+}
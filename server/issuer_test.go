@@ -0,0 +1,430 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+
+	"github.com/offblast/achmed/proto"
+)
+
+func TestCoversNames(t *testing.T) {
+	leaf := selfSigned(t, "example.com", "*.tenant.example.com").Leaf
+
+	tests := []struct {
+		names []string
+		want  bool
+	}{
+		{[]string{"example.com"}, true},
+		{[]string{"*.tenant.example.com", "example.com"}, true},
+		{[]string{"a.tenant.example.com"}, false},
+		{[]string{"example.com", "www.example.com"}, false},
+	}
+
+	for _, tt := range tests {
+		if got := coversNames(leaf, tt.names); got != tt.want {
+			t.Errorf("coversNames(%v) = %v, want %v", tt.names, got, tt.want)
+		}
+	}
+}
+
+func TestIssuerHTTPChallenge(t *testing.T) {
+	a := &AchmedServer{
+		issuer: &issuer{tokens: map[string][]byte{"token": []byte("token.thumbprint")}},
+	}
+
+	resp, err := a.GetHTTPChallenge(context.Background(), &proto.HTTPChallengeRequest{Host: "example.com", Token: "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(resp.Keyauthorization) != "token.thumbprint" {
+		t.Fatalf("expected key authorization %q, got %q", "token.thumbprint", resp.Keyauthorization)
+	}
+}
+
+// testDNSProvider is a DNSProvider keeping TXT records in memory.
+type testDNSProvider struct {
+	mu      sync.Mutex
+	records map[string][]string
+	cleaned int
+}
+
+func (p *testDNSProvider) Present(ctx context.Context, fqdn, value string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.records[fqdn] = append(p.records[fqdn], value)
+	return nil
+}
+
+func (p *testDNSProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var kept []string
+	for _, v := range p.records[fqdn] {
+		if v != value {
+			kept = append(kept, v)
+		}
+	}
+	p.records[fqdn] = kept
+	p.cleaned++
+	return nil
+}
+
+func (p *testDNSProvider) serves(fqdn, value string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, v := range p.records[fqdn] {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// testOrderACME is an ACME server issuing certificates for names, with
+// an authorization per name offering TLS-ALPN-01, HTTP-01 and DNS-01
+// challenges. An accepted challenge is valid if validate says so. Every
+// new order starts with pending authorizations.
+type testOrderACME struct {
+	*httptest.Server
+	names    []string
+	validate func(typ, name, token string) bool
+
+	mu     sync.Mutex
+	orders int
+	authz  []string
+	cert   []byte
+}
+
+var testChallengeTypes = []string{"tls-alpn-01", "http-01", "dns-01"}
+
+func newTestOrderACME(t *testing.T, names ...string) *testOrderACME {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	s := &testOrderACME{names: names, authz: make([]string, len(names))}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+
+		var jws struct {
+			Payload string `json:"payload"`
+		}
+		if r.Method == "POST" {
+			json.NewDecoder(r.Body).Decode(&jws)
+		}
+		payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+
+		// authorizations and challenges are numbered from 1, challenges
+		// are at /chal/<type>/<n>.
+		path := r.URL.Path
+		n, _ := strconv.Atoi(path[strings.LastIndexByte(path, '/')+1:])
+		if n < 0 || n > len(names) {
+			n = 0
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		switch {
+		case path == "/directory":
+			fmt.Fprintf(w, `{"newNonce": %q, "newAccount": %q, "newOrder": %q}`, s.URL+"/nonce", s.URL+"/account", s.URL+"/order")
+
+		case path == "/nonce":
+
+		case path == "/account":
+			w.Header().Set("Location", s.URL+"/account/1")
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"status": "valid"}`)
+
+		case path == "/order":
+			s.orders++
+			for n := range s.authz {
+				s.authz[n] = acme.StatusPending
+			}
+
+			w.Header().Set("Location", s.URL+"/order/1")
+			w.WriteHeader(http.StatusCreated)
+			s.writeOrder(w, "pending", "")
+
+		case path == "/order/1":
+			status := "ready"
+			for _, z := range s.authz {
+				if z != acme.StatusValid {
+					status = acme.StatusInvalid
+				}
+			}
+			s.writeOrder(w, status, "")
+
+		case strings.HasPrefix(path, "/authz/") && n > 0:
+			var chals []string
+			for _, typ := range testChallengeTypes {
+				chals = append(chals, fmt.Sprintf(`{"type": %q, "url": "%s/chal/%s/%d", "token": "t0ken%d"}`, typ, s.URL, typ, n, n))
+			}
+
+			fmt.Fprintf(w, `{"status": %q, "identifier": {"type": "dns", "value": %q}, "challenges": [%s]}`,
+				s.authz[n-1], names[n-1], strings.Join(chals, ", "))
+
+		case strings.HasPrefix(path, "/chal/") && n > 0:
+			typ := strings.Split(path, "/")[2]
+			token := fmt.Sprintf("t0ken%d", n)
+
+			s.authz[n-1] = acme.StatusInvalid
+			if s.validate(typ, names[n-1], token) {
+				s.authz[n-1] = acme.StatusValid
+			}
+
+			fmt.Fprintf(w, `{"type": %q, "url": "%s%s", "token": %q, "status": %q}`, typ, s.URL, path, token, s.authz[n-1])
+
+		case path == "/finalize":
+			var req struct {
+				CSR string `json:"csr"`
+			}
+			json.Unmarshal(payload, &req)
+
+			der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+			csr, err := x509.ParseCertificateRequest(der)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			leaf := &x509.Certificate{
+				SerialNumber: big.NewInt(2),
+				Subject:      csr.Subject,
+				DNSNames:     csr.DNSNames,
+				NotBefore:    time.Now().Add(-time.Hour),
+				NotAfter:     time.Now().Add(24 * time.Hour),
+			}
+
+			if s.cert, err = x509.CreateCertificate(rand.Reader, leaf, ca, csr.PublicKey, caKey); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			s.writeOrder(w, "valid", s.URL+"/cert")
+
+		case path == "/cert":
+			w.Header().Set("Content-Type", "application/pem-certificate-chain")
+			pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: s.cert})
+
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	return s
+}
+
+func (s *testOrderACME) writeOrder(w http.ResponseWriter, status, certURL string) {
+	var ids, authz []string
+	for n, name := range s.names {
+		ids = append(ids, fmt.Sprintf(`{"type": "dns", "value": %q}`, name))
+		authz = append(authz, fmt.Sprintf("%q", fmt.Sprintf("%s/authz/%d", s.URL, n+1)))
+	}
+
+	fmt.Fprintf(w, `{"status": %q, "identifiers": [%s], "authorizations": [%s], "finalize": %q, "certificate": %q}`,
+		status, strings.Join(ids, ", "), strings.Join(authz, ", "), s.URL+"/finalize", certURL)
+}
+
+func (s *testOrderACME) numOrders() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.orders
+}
+
+func TestIssuerDNSChallenge(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &acme.Client{Key: key}
+	p := &testDNSProvider{records: make(map[string][]string)}
+
+	srv := newTestOrderACME(t, "example.com", "*.example.com")
+	defer srv.Close()
+	client.DirectoryURL = srv.URL + "/directory"
+
+	// DNS-01 challenges are valid if their record is published.
+	srv.validate = func(typ, name, token string) bool {
+		value, err := client.DNS01ChallengeRecord(token)
+		return err == nil && typ == "dns-01" && p.serves("_acme-challenge."+strings.TrimPrefix(name, "*.")+".", value)
+	}
+
+	i, err := newIssuer(&autocert.Manager{Client: client}, p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cert, err := i.issue(ctx, []string{"example.com", "*.example.com"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !coversNames(cert.Leaf, []string{"example.com", "*.example.com"}) {
+		t.Fatalf("expected certificate for the names ordered, got %v", cert.Leaf.DNSNames)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cleaned != 2 || len(p.records["_acme-challenge.example.com."]) != 0 {
+		t.Fatalf("expected both TXT records to be cleaned up, got %d clean ups and %v", p.cleaned, p.records)
+	}
+}
+
+func TestIssuerChallengeFallback(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &acme.Client{Key: key}
+
+	srv := newTestOrderACME(t, "example.com", "www.example.com")
+	defer srv.Close()
+	client.DirectoryURL = srv.URL + "/directory"
+
+	i, err := newIssuer(&autocert.Manager{Client: client}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the names can't be reached on port 443, only on port 80.
+	srv.validate = func(typ, name, token string) bool {
+		want, err := client.HTTP01ChallengeResponse(token)
+		got, ok := i.httpToken(token)
+		return err == nil && typ == "http-01" && ok && string(got) == want
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cert, err := i.issue(ctx, []string{"example.com", "www.example.com"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !coversNames(cert.Leaf, []string{"example.com", "www.example.com"}) || srv.numOrders() != 2 {
+		t.Fatalf("expected certificate from a second order with HTTP-01, got %v after %d orders", cert.Leaf.DNSNames, srv.numOrders())
+	}
+
+	// without any valid challenge type, issuing fails.
+	srv.validate = func(typ, name, token string) bool { return false }
+
+	if _, err := i.issue(ctx, []string{"example.com", "www.example.com"}, false); err == nil || srv.numOrders() != 4 {
+		t.Fatalf("expected issuing to fail after an order per challenge type, got %v after %d orders", err, srv.numOrders())
+	}
+}
+
+// failingCache is a cache failing to store the certificate under key.
+type failingCache struct {
+	autocert.Cache
+	key string
+}
+
+func (c *failingCache) Put(ctx context.Context, key string, data []byte) error {
+	if key == c.key {
+		return errors.New("cache full")
+	}
+	return c.Cache.Put(ctx, key, data)
+}
+
+func TestIssuerCacheFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "achmed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &acme.Client{Key: key}
+
+	srv := newTestOrderACME(t, "example.com")
+	defer srv.Close()
+	client.DirectoryURL = srv.URL + "/directory"
+	srv.validate = func(typ, name, token string) bool { return typ == "tls-alpn-01" }
+
+	c := &failingCache{Cache: autocert.DirCache(dir), key: "example.com"}
+	i, err := newIssuer(&autocert.Manager{Client: client, Cache: c}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := i.GetCertificate("example.com", []string{"example.com"}, false); err == nil {
+		t.Fatalf("expected failure to cache the certificate to be returned")
+	}
+
+	// the certificate is served from memory, despite the cache miss.
+	cert, err := i.GetCertificate("example.com", []string{"example.com"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if srv.numOrders() != 1 {
+		t.Fatalf("expected one order, got %d", srv.numOrders())
+	}
+
+	// another replica revoked it.
+	data, err := json.Marshal(replacedMarker{Serial: fmt.Sprintf("%x", cert.Leaf.SerialNumber), NotAfter: cert.Leaf.NotAfter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put(context.Background(), replacedKey("example.com"), data); err != nil {
+		t.Fatal(err)
+	}
+
+	i.mu.Lock()
+	i.reloaded["example.com"] = time.Time{}
+	i.mu.Unlock()
+
+	if i.cached(context.Background(), "example.com", []string{"example.com"}) != nil {
+		t.Fatalf("expected revoked certificate to be dropped")
+	}
+}
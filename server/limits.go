@@ -0,0 +1,387 @@
+package server
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+	"golang.org/x/net/publicsuffix"
+)
+
+// limitWindow is the sliding window Let's Encrypt applies its limits over.
+const limitWindow = 7 * 24 * time.Hour
+
+// Limits are weekly issuance limits, modelled after the Let's Encrypt
+// rate limits. A zero limit is not enforced.
+type Limits struct {
+	// PerDomain is how many certificates may be issued per registered
+	// domain, e.g. example.com for www.example.com, per week.
+	PerDomain int
+
+	// PerNameSet is how many certificates may be issued for the exact
+	// same set of names per week.
+	PerNameSet int
+}
+
+// DefaultLimits are the Let's Encrypt production limits.
+var DefaultLimits = Limits{PerDomain: 50, PerNameSet: 5}
+
+// RateLimitError is returned when issuing a certificate would go over
+// the configured limits.
+type RateLimitError struct {
+	// Domain is the registered domain whose budget is exhausted.
+	Domain string
+
+	// Limit names the exhausted limit, "domain" or "name set".
+	Limit string
+
+	// RetryAfter is when the oldest counted issuance leaves the window.
+	RetryAfter time.Time
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("achmed: weekly %s limit reached for %q, retry after %s", e.Limit, e.Domain, e.RetryAfter.Format(time.RFC3339))
+}
+
+// Budget is the remaining weekly issuance budget of a registered domain.
+type Budget struct {
+	Domain    string
+	Limit     int
+	Used      int
+	Remaining int
+
+	// Reset is when the oldest counted issuance leaves the window,
+	// zero if nothing was issued this week.
+	Reset time.Time
+}
+
+// issuance is one certificate counted against the limits.
+type issuance struct {
+	Names []string  `json:"names"`
+	Time  time.Time `json:"time"`
+}
+
+// issuanceLog records issuances per registered domain in an
+// autocert.Cache, under "<domain>+issuances", so that all replicas
+// sharing the cache share the budget.
+//
+// Without a cache the records are only kept in memory.
+type issuanceLog struct {
+	cache  autocert.Cache
+	limits Limits
+
+	// mu serializes updates within this process. Replicas may still
+	// race, which at worst undercounts an issuance.
+	mu  sync.Mutex
+	mem map[string][]issuance
+
+	now func() time.Time
+}
+
+func newIssuanceLog(cache autocert.Cache, limits Limits) *issuanceLog {
+	return &issuanceLog{
+		cache:  cache,
+		limits: limits,
+		mem:    make(map[string][]issuance),
+		now:    time.Now,
+	}
+}
+
+// registeredDomain returns the public suffix plus one label of name, or
+// name itself if it has none, e.g. for IP addresses.
+func registeredDomain(name string) string {
+	name = normalizeHost(strings.TrimPrefix(name, "*."))
+	if net.ParseIP(name) != nil {
+		return name
+	}
+
+	d, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil {
+		return name
+	}
+
+	return d
+}
+
+// nameSet returns the canonical form of names, sorted and without duplicates.
+func nameSet(names []string) []string {
+	seen := make(map[string]bool)
+	var set []string
+
+	for _, n := range names {
+		n = normalizeHost(n)
+		if !seen[n] {
+			seen[n] = true
+			set = append(set, n)
+		}
+	}
+
+	sort.Strings(set)
+	return set
+}
+
+func sameNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// domains returns the registered domains of names, without duplicates.
+func domains(names []string) []string {
+	seen := make(map[string]bool)
+	var ds []string
+
+	for _, n := range names {
+		if d := registeredDomain(n); !seen[d] {
+			seen[d] = true
+			ds = append(ds, d)
+		}
+	}
+
+	return ds
+}
+
+func (l *issuanceLog) key(domain string) string {
+	return domain + "+issuances"
+}
+
+// load returns the issuances of domain within the window.
+func (l *issuanceLog) load(ctx context.Context, domain string) ([]issuance, error) {
+	var recs []issuance
+
+	if l.cache == nil {
+		recs = l.mem[domain]
+	} else {
+		data, err := l.cache.Get(ctx, l.key(domain))
+		if err == autocert.ErrCacheMiss {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal(data, &recs); err != nil {
+			return nil, err
+		}
+	}
+
+	since := l.now().Add(-limitWindow)
+
+	var recent []issuance
+	for _, r := range recs {
+		if r.Time.After(since) {
+			recent = append(recent, r)
+		}
+	}
+
+	return recent, nil
+}
+
+func (l *issuanceLog) store(ctx context.Context, domain string, recs []issuance) error {
+	if l.cache == nil {
+		l.mem[domain] = recs
+		return nil
+	}
+
+	data, err := json.Marshal(recs)
+	if err != nil {
+		return err
+	}
+
+	return l.cache.Put(ctx, l.key(domain), data)
+}
+
+// check returns a *RateLimitError if a certificate for names would go
+// over the limits. A nil log has no limits.
+func (l *issuanceLog) check(ctx context.Context, names []string) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	set := nameSet(names)
+
+	for _, d := range domains(set) {
+		recs, err := l.load(ctx, d)
+		if err != nil {
+			return err
+		}
+
+		if l.limits.PerDomain > 0 && len(recs) >= l.limits.PerDomain {
+			return &RateLimitError{Domain: d, Limit: "domain", RetryAfter: recs[0].Time.Add(limitWindow)}
+		}
+
+		if l.limits.PerNameSet > 0 {
+			var same []issuance
+			for _, r := range recs {
+				if sameNames(r.Names, set) {
+					same = append(same, r)
+				}
+			}
+
+			if len(same) >= l.limits.PerNameSet {
+				return &RateLimitError{Domain: d, Limit: "name set", RetryAfter: same[0].Time.Add(limitWindow)}
+			}
+		}
+	}
+
+	return nil
+}
+
+// record counts a certificate for names against the limits.
+func (l *issuanceLog) record(ctx context.Context, names []string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	set := nameSet(names)
+
+	for _, d := range domains(set) {
+		recs, err := l.load(ctx, d)
+		if err != nil {
+			return err
+		}
+
+		recs = append(recs, issuance{Names: set, Time: l.now()})
+		if err := l.store(ctx, d, recs); err != nil {
+			return err
+		}
+
+		if l.limits.PerDomain > 0 {
+			log.Printf("achmed: %d of %d certificates left this week for %q", l.limits.PerDomain-len(recs), l.limits.PerDomain, d)
+		}
+	}
+
+	return nil
+}
+
+// budget returns the remaining weekly budget of the registered domain of name.
+func (l *issuanceLog) budget(ctx context.Context, name string) (*Budget, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	d := registeredDomain(name)
+
+	recs, err := l.load(ctx, d)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Budget{
+		Domain: d,
+		Limit:  l.limits.PerDomain,
+		Used:   len(recs),
+	}
+
+	if b.Limit > 0 && b.Used < b.Limit {
+		b.Remaining = b.Limit - b.Used
+	}
+
+	if len(recs) > 0 {
+		b.Reset = recs[0].Time.Add(limitWindow)
+	}
+
+	return b, nil
+}
+
+// challengeKey marks contexts of HTTP-01 challenge lookups, which go
+// through the host policy but never order a certificate.
+type challengeKey struct{}
+
+// hostPolicy wraps policy to also refuse names whose budget is exhausted.
+// autocert only consults its host policy before ordering a certificate
+// and when answering HTTP-01 challenges.
+func (l *issuanceLog) hostPolicy(policy autocert.HostPolicy) autocert.HostPolicy {
+	return func(ctx context.Context, host string) error {
+		if policy != nil {
+			if err := policy(ctx, host); err != nil {
+				return err
+			}
+		}
+
+		if ctx.Value(challengeKey{}) != nil {
+			return nil
+		}
+
+		return l.check(ctx, []string{host})
+	}
+}
+
+// recordingCache is an autocert.Cache that records every certificate
+// written to it in an issuanceLog. autocert only writes certificates to
+// its cache after issuing them, and TLS-ALPN-01 challenge certificates
+// under "<name>+token", which are not counted.
+//
+// A nil Cache behaves like an empty cache.
+type recordingCache struct {
+	autocert.Cache
+	log *issuanceLog
+}
+
+func (c *recordingCache) Get(ctx context.Context, key string) ([]byte, error) {
+	if c.Cache == nil {
+		return nil, autocert.ErrCacheMiss
+	}
+
+	return c.Cache.Get(ctx, key)
+}
+
+func (c *recordingCache) Put(ctx context.Context, key string, data []byte) error {
+	if leaf := leafCertificate(data); leaf != nil && !strings.HasSuffix(key, "+token") {
+		if err := c.log.record(ctx, leaf.DNSNames); err != nil {
+			log.Printf("achmed: failed to record issuance for %q: %v", key, err)
+		}
+	}
+
+	if c.Cache == nil {
+		return nil
+	}
+
+	return c.Cache.Put(ctx, key, data)
+}
+
+func (c *recordingCache) Delete(ctx context.Context, key string) error {
+	if c.Cache == nil {
+		return nil
+	}
+
+	return c.Cache.Delete(ctx, key)
+}
+
+// leafCertificate returns the first certificate PEM encoded in data, or
+// nil if there is none.
+func leafCertificate(data []byte) *x509.Certificate {
+	for {
+		var b *pem.Block
+		b, data = pem.Decode(data)
+		if b == nil {
+			return nil
+		}
+
+		if b.Type == "CERTIFICATE" {
+			leaf, err := x509.ParseCertificate(b.Bytes)
+			if err != nil {
+				return nil
+			}
+			return leaf
+		}
+	}
+}
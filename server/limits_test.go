@@ -0,0 +1,117 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+)
+
+func TestRegisteredDomain(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"www.example.com", "example.com"},
+		{"*.Example.com", "example.com"},
+		{"a.b.example.co.uk", "example.co.uk"},
+		{"co.uk", "co.uk"},
+		{"192.0.2.1", "192.0.2.1"},
+	}
+
+	for _, tt := range tests {
+		if got := registeredDomain(tt.name); got != tt.want {
+			t.Errorf("registeredDomain(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIssuanceLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "achmed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, cache := range []autocert.Cache{nil, autocert.DirCache(dir)} {
+		l := newIssuanceLog(cache, Limits{PerDomain: 3, PerNameSet: 2})
+
+		now := time.Now()
+		l.now = func() time.Time { return now }
+
+		ctx := context.Background()
+
+		for i := 0; i < 2; i++ {
+			if err := l.check(ctx, []string{"www.example.com"}); err != nil {
+				t.Fatalf("expected nil error, got %q", err)
+			}
+			if err := l.record(ctx, []string{"www.example.com"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err := l.check(ctx, []string{"WWW.example.com."})
+		if rl, ok := err.(*RateLimitError); !ok || rl.Limit != "name set" {
+			t.Fatalf("expected name set limit, got %v", err)
+		}
+
+		if err := l.record(ctx, []string{"mail.example.com"}); err != nil {
+			t.Fatal(err)
+		}
+
+		err = l.check(ctx, []string{"ftp.example.com"})
+		if rl, ok := err.(*RateLimitError); !ok || rl.Limit != "domain" || rl.Domain != "example.com" {
+			t.Fatalf("expected domain limit for example.com, got %v", err)
+		}
+
+		if err := l.check(ctx, []string{"www.example.org"}); err != nil {
+			t.Fatalf("expected nil error for other domain, got %q", err)
+		}
+
+		b, err := l.budget(ctx, "www.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.Used != 3 || b.Remaining != 0 || !b.Reset.Equal(now.Add(limitWindow)) {
+			t.Fatalf("unexpected budget %+v", b)
+		}
+
+		now = now.Add(limitWindow + time.Second)
+
+		if err := l.check(ctx, []string{"www.example.com"}); err != nil {
+			t.Fatalf("expected nil error after a week, got %q", err)
+		}
+	}
+}
+
+func TestRecordingCache(t *testing.T) {
+	l := newIssuanceLog(nil, Limits{PerDomain: 1})
+	c := &recordingCache{log: l}
+	ctx := context.Background()
+
+	msg, err := certificateToProto(selfSigned(t, "example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := msg.Pem
+
+	if err := c.Put(ctx, "example.com+token", data); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.check(ctx, []string{"example.com"}); err != nil {
+		t.Fatalf("expected challenge certificates not to count, got %q", err)
+	}
+
+	if err := c.Put(ctx, "example.com", data); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.check(ctx, []string{"example.com"}); err == nil {
+		t.Fatalf("expected issued certificate to count")
+	}
+
+	if _, err := c.Get(ctx, "example.com"); err != autocert.ErrCacheMiss {
+		t.Fatalf("expected cache miss without cache, got %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"crypto/tls"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Locker hands out named locks shared by all replicas of a server, e.g.
+// cache.EtcdLocker.
+type Locker interface {
+	// Lock blocks until it holds the lock called name or ctx is done.
+	// The returned function releases the lock.
+	Lock(ctx context.Context, name string) (func(), error)
+}
+
+// WithLocker makes replicas sharing a cache take turns ordering a
+// certificate: only the holder of the certificate's lock orders it, the
+// others wait for the lock and then find the certificate in the cache.
+//
+// Renewals take the lock too, as the server's own issuer then obtains
+// all certificates. That needs an ACME client with a key; without one,
+// only first orders are serialized.
+func WithLocker(l Locker) Option {
+	return func(a *AchmedServer) {
+		a.locker = l
+	}
+}
+
+func unlocked() {}
+
+// lockIssuance takes the lock for the certificate for name that autocert
+// stores under key, unless a valid one was served before or is in the
+// cache, so it won't be ordered.
+func (a *AchmedServer) lockIssuance(ctx context.Context, key, name string) (func(), error) {
+	if a.locker == nil {
+		return unlocked, nil
+	}
+
+	a.mu.Lock()
+	served := a.served[key]
+	a.mu.Unlock()
+
+	if time.Now().Before(served) {
+		return unlocked, nil
+	}
+
+	if cert := a.cachedCertificate(ctx, key); cert != nil && time.Now().Before(cert.Leaf.NotAfter) && cert.Leaf.VerifyHostname(name) == nil {
+		return unlocked, nil
+	}
+
+	return a.locker.Lock(ctx, "cert/"+key)
+}
+
+// markServed records that cert was served under key.
+func (a *AchmedServer) markServed(key string, cert *tls.Certificate) {
+	if a.locker == nil {
+		return
+	}
+
+	a.mu.Lock()
+	a.served[key] = cert.Leaf.NotAfter
+	a.mu.Unlock()
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+
+	"github.com/offblast/achmed/proto"
+)
+
+// countingLocker counts the locks taken.
+type countingLocker struct {
+	locked int
+}
+
+func (l *countingLocker) Lock(ctx context.Context, name string) (func(), error) {
+	l.locked++
+	return func() {}, nil
+}
+
+func TestLockIssuance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "achmed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l := &countingLocker{}
+	a, err := New("", autocert.DirCache(dir), nil, nil, WithLocker(l))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	lock := func(key string) {
+		unlock, err := a.lockIssuance(ctx, key, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unlock()
+	}
+
+	put := func(key string, cert *tls.Certificate) {
+		data, err := certificatePEM(cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.m.Cache.Put(ctx, key, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lock("example.com")
+	if l.locked != 1 {
+		t.Fatalf("expected lock for missing certificate, got %d locks", l.locked)
+	}
+
+	a.markServed("example.com", selfSigned(t, "example.com"))
+	lock("example.com")
+
+	put("example.org", selfSigned(t, "example.org"))
+	lock("example.org")
+
+	if l.locked != 1 {
+		t.Fatalf("expected no lock for served or cached certificates, got %d locks", l.locked)
+	}
+
+	// certificates that can't be served anymore are ordered again.
+	expired := selfSignedUntil(t, time.Now().Add(-time.Hour), "example.net")
+	a.markServed("example.net", expired)
+	put("example.net", expired)
+	lock("example.net")
+
+	put("www.example.org", selfSigned(t, "example.org"))
+	lock("www.example.org")
+
+	if err := a.m.Cache.Put(ctx, "example.info", []byte("cert")); err != nil {
+		t.Fatal(err)
+	}
+	lock("example.info")
+
+	if l.locked != 4 {
+		t.Fatalf("expected locks for expired, mismatched and invalid certificates, got %d locks", l.locked)
+	}
+}
+
+// storingLocker stores cert in cache when a lock is taken, like another
+// replica that held the lock before.
+type storingLocker struct {
+	cache autocert.Cache
+	key   string
+	cert  *tls.Certificate
+}
+
+func (l *storingLocker) Lock(ctx context.Context, name string) (func(), error) {
+	data, err := certificatePEM(l.cert)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {}, l.cache.Put(ctx, l.key, data)
+}
+
+func TestLockFirstOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "achmed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := newTestOrderACME(t, "example.com")
+	defer srv.Close()
+	srv.validate = func(typ, name, token string) bool { return true }
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	c := autocert.DirCache(dir)
+
+	// the cached certificate expired, another replica is ordering a new one.
+	data, err := certificatePEM(selfSignedUntil(t, time.Now().Add(-time.Hour), "example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put(ctx, "example.com", data); err != nil {
+		t.Fatal(err)
+	}
+
+	l := &storingLocker{cache: c, key: "example.com", cert: selfSigned(t, "example.com")}
+	a, err := New("", c, &acme.Client{Key: key, DirectoryURL: srv.URL + "/directory"}, nil, WithLocker(l))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hello := &proto.ClientHelloInfo{Servername: "example.com", Ciphersuites: []uint32{0xc02b}, Supportedcurves: []uint32{23}}
+	cert, err := a.GetCertificate(ctx, hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cert.Fingerprint != fingerprint(l.cert.Leaf.Raw) || srv.numOrders() != 0 {
+		t.Fatalf("expected the other replica's certificate without an order, got %d orders", srv.numOrders())
+	}
+}
+
+// reportingLocker reports the names of the locks taken.
+type reportingLocker struct {
+	names chan string
+}
+
+func (l *reportingLocker) Lock(ctx context.Context, name string) (func(), error) {
+	l.names <- name
+	return func() {}, nil
+}
+
+func TestLockRenewal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "achmed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := newTestACME()
+	defer srv.Close()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	c := autocert.DirCache(dir)
+
+	// a certificate due for renewal.
+	data, err := certificatePEM(selfSignedUntil(t, time.Now().Add(24*time.Hour), "example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put(ctx, "example.com", data); err != nil {
+		t.Fatal(err)
+	}
+
+	l := &reportingLocker{names: make(chan string, 10)}
+	a, err := New("", c, &acme.Client{Key: key, DirectoryURL: srv.URL + "/directory"}, nil, WithLocker(l))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hello := &proto.ClientHelloInfo{Servername: "example.com", Ciphersuites: []uint32{0xc02b}, Supportedcurves: []uint32{23}}
+	if _, err := a.GetCertificate(ctx, hello); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case name := <-l.names:
+		if name != "cert/example.com" {
+			t.Fatalf("expected renewal to take the certificate's lock, got %q", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected renewal to take the certificate's lock")
+	}
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+)
+
+// ErrHostNotAllowed is returned by host policies for names that may not
+// get a certificate.
+var ErrHostNotAllowed = errors.New("achmed: host not allowed by policy")
+
+// HostRules describes which host names may get certificates.
+type HostRules struct {
+	// Exact lists host names that are allowed as is.
+	Exact []string
+
+	// Suffixes lists domains that are allowed along with all their
+	// subdomains, e.g. "example.com" allows example.com and www.example.com.
+	Suffixes []string
+
+	// Regexps lists expressions host names are allowed to match.
+	// They are matched against the whole name.
+	Regexps []*regexp.Regexp
+}
+
+// Empty reports whether r has no rules at all.
+func (r *HostRules) Empty() bool {
+	return len(r.Exact) == 0 && len(r.Suffixes) == 0 && len(r.Regexps) == 0
+}
+
+// Allowed reports whether host matches any of the rules.
+// Host names are compared case insensitively.
+func (r *HostRules) Allowed(host string) bool {
+	host = normalizeHost(host)
+	if host == "" {
+		return false
+	}
+
+	for _, h := range r.Exact {
+		if normalizeHost(h) == host {
+			return true
+		}
+	}
+
+	for _, s := range r.Suffixes {
+		s = normalizeHost(s)
+		if s != "" && (host == s || strings.HasSuffix(host, "."+s)) {
+			return true
+		}
+	}
+
+	for _, re := range r.Regexps {
+		if wholeName(re).MatchString(host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// wholeNames caches the regexps of HostRules compiled to only match whole
+// names. They come from configuration, so there are few of them.
+var wholeNames = struct {
+	sync.Mutex
+	m map[*regexp.Regexp]*regexp.Regexp
+}{m: make(map[*regexp.Regexp]*regexp.Regexp)}
+
+// wholeName returns re anchored at both ends. A match of re found at the
+// start of a name may be shorter than the name even though re matches
+// all of it, e.g. with alternations.
+func wholeName(re *regexp.Regexp) *regexp.Regexp {
+	wholeNames.Lock()
+	defer wholeNames.Unlock()
+
+	whole, ok := wholeNames.m[re]
+	if !ok {
+		// re compiled, so does the anchored expression.
+		whole = regexp.MustCompile(`^(?:` + re.String() + `)$`)
+		wholeNames.m[re] = whole
+	}
+
+	return whole
+}
+
+// HostPolicy returns an autocert.HostPolicy that allows the names matching
+// r and rejects all others with ErrHostNotAllowed.
+func (r *HostRules) HostPolicy() autocert.HostPolicy {
+	return func(_ context.Context, host string) error {
+		if !r.Allowed(host) {
+			return ErrHostNotAllowed
+		}
+		return nil
+	}
+}
+
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// normalizedNames returns names normalized with normalizeHost.
+func normalizedNames(names []string) []string {
+	normalized := make([]string, len(names))
+	for n, name := range names {
+		normalized[n] = normalizeHost(name)
+	}
+	return normalized
+}
+
+// AnyHostPolicy returns an autocert.HostPolicy that allows a host name if
+// any of policies allows it. The error of the last policy is returned
+// otherwise.
+func AnyHostPolicy(policies ...autocert.HostPolicy) autocert.HostPolicy {
+	return func(ctx context.Context, host string) error {
+		err := ErrHostNotAllowed
+		for _, p := range policies {
+			if err = p(ctx, host); err == nil {
+				return nil
+			}
+		}
+		return err
+	}
+}
+
+// IdentityMap maps a server name to the name of the certificate served
+// for it, e.g. www.example.com to *.example.com. Names mapped to
+// themselves get a certificate of their own.
+type IdentityMap func(host string) string
+
+// WithIdentities makes the server look up, issue and cache certificates
+// by the identity m maps server names to. Wildcard identities need a
+// DNSProvider.
+func WithIdentities(m IdentityMap) Option {
+	return func(a *AchmedServer) {
+		a.identities = m
+	}
+}
+
+// WildcardIdentities returns an IdentityMap that maps the names directly
+// below any of domains to the wildcard certificate of that domain.
+// All other names map to themselves.
+func WildcardIdentities(domains ...string) IdentityMap {
+	return func(host string) string {
+		h := normalizeHost(host)
+
+		i := strings.Index(h, ".")
+		if i <= 0 {
+			return host
+		}
+
+		for _, d := range domains {
+			if normalizeHost(d) == h[i+1:] {
+				return "*." + h[i+1:]
+			}
+		}
+
+		return host
+	}
+}
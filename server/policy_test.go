@@ -0,0 +1,158 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"regexp"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestHostRules(t *testing.T) {
+	rules := &HostRules{
+		Exact:    []string{"example.com"},
+		Suffixes: []string{"example.org"},
+		Regexps: []*regexp.Regexp{
+			regexp.MustCompile(`tenant[0-9]+\.example\.net`),
+			regexp.MustCompile(`foo|foo\.example\.com`),
+		},
+	}
+
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"example.com", true},
+		{"Example.COM.", true},
+		{"www.example.com", false},
+		{"example.org", true},
+		{"www.example.org", true},
+		{"badexample.org", false},
+		{"tenant1.example.net", true},
+		{"tenant1.example.net.evil.com", false},
+		{"xtenant1.example.net", false},
+		{"foo", true},
+		{"foo.example.com", true},
+		{"foo.example.com.evil.com", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := rules.Allowed(tt.host); got != tt.want {
+			t.Errorf("Allowed(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+
+	policy := rules.HostPolicy()
+	if err := policy(context.Background(), "evil.com"); err != ErrHostNotAllowed {
+		t.Errorf("expected ErrHostNotAllowed, got %v", err)
+	}
+}
+
+func TestAnyHostPolicy(t *testing.T) {
+	policy := AnyHostPolicy(
+		(&HostRules{Exact: []string{"example.com"}}).HostPolicy(),
+		(&HostRules{Suffixes: []string{"example.org"}}).HostPolicy(),
+	)
+
+	ctx := context.Background()
+
+	if err := policy(ctx, "example.com"); err != nil {
+		t.Errorf("expected nil error, got %q", err)
+	}
+
+	if err := policy(ctx, "www.example.org"); err != nil {
+		t.Errorf("expected nil error, got %q", err)
+	}
+
+	if err := policy(ctx, "example.net"); err != ErrHostNotAllowed {
+		t.Errorf("expected ErrHostNotAllowed, got %v", err)
+	}
+}
+
+func TestWildcardIdentities(t *testing.T) {
+	identity := WildcardIdentities("tenant.example.com", "Example.org.")
+
+	tests := []struct {
+		host, want string
+	}{
+		{"a.tenant.example.com", "*.tenant.example.com"},
+		{"B.Tenant.example.com.", "*.tenant.example.com"},
+		{"x.a.tenant.example.com", "x.a.tenant.example.com"},
+		{"tenant.example.com", "tenant.example.com"},
+		{"www.example.org", "*.example.org"},
+		{"www.example.net", "www.example.net"},
+		{"localhost", "localhost"},
+	}
+
+	for _, tt := range tests {
+		if got := identity(tt.host); got != tt.want {
+			t.Errorf("identity(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestIdentityAuthorization(t *testing.T) {
+	auth, err := ParseAuthorizer(strings.NewReader(`
+client alice alice.users.example.com
+client users .users.example.com
+token alice alice
+token users users
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := New("", nil, &acme.Client{Key: key}, nil, WithAuthorizer(auth),
+		WithDNSProvider(&RFC2136Provider{}), WithIdentities(WildcardIdentities("users.example.com")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caller := func(token string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+	}
+
+	// alice may not get the key of the wildcard certificate of all users.
+	if _, _, err := a.certificateFor(caller("alice"), &tls.ClientHelloInfo{ServerName: "alice.users.example.com"}); grpc.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected wildcard identity to be denied, got %v", err)
+	}
+
+	ck, names, err := a.certificateFor(caller("users"), &tls.ClientHelloInfo{ServerName: "alice.users.example.com"})
+	if err != nil || ck != "*.users.example.com+rsa" || len(names) != 1 || names[0] != "*.users.example.com" {
+		t.Fatalf("expected wildcard certificate, got %q, %v, %v", ck, names, err)
+	}
+}
+
+func TestCertificateForNormalizes(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := New("", nil, &acme.Client{Key: key}, (&HostRules{Exact: []string{"example.com"}}).HostPolicy())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"example.com", "Example.COM", "example.com."} {
+		chi := &tls.ClientHelloInfo{ServerName: name}
+		ck, _, err := a.certificateFor(context.Background(), chi)
+		if err != nil || ck != "example.com+rsa" || chi.ServerName != "example.com" {
+			t.Errorf("%s: expected key example.com+rsa, got %q, %q, %v", name, ck, chi.ServerName, err)
+		}
+	}
+}
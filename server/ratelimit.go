@@ -0,0 +1,279 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	"github.com/offblast/achmed/proto"
+)
+
+// bucketIdle is how long an unused token bucket is kept.
+const bucketIdle = 10 * time.Minute
+
+// RateLimits bound how fast callers may ask for certificates.
+// A zero rate is not enforced.
+type RateLimits struct {
+	// PerClient and ClientBurst bound the calls of each caller. Callers
+	// are identified by the authorizer if there is one, else by address.
+	PerClient   rate.Limit
+	ClientBurst int
+
+	// PerName and NameBurst bound the certificate orders for each
+	// server name, across all callers. Certificates served from memory or
+	// the cache are not counted.
+	PerName   rate.Limit
+	NameBurst int
+
+	// FailureTTL is how long a failure to get a certificate is returned
+	// for the same name without asking the ACME server again.
+	FailureTTL time.Duration
+}
+
+// WithRateLimits limits calls as described by limits. Client rate limits
+// are applied by the interceptors returned by AchmedServer.UnaryInterceptor
+// and StreamInterceptor.
+func WithRateLimits(limits RateLimits) Option {
+	return func(a *AchmedServer) {
+		a.clients = newBuckets(limits.PerClient, limits.ClientBurst)
+		a.names = newBuckets(limits.PerName, limits.NameBurst)
+		if limits.FailureTTL > 0 {
+			a.failures = newFailureCache(limits.FailureTTL)
+		}
+	}
+}
+
+// buckets holds a token bucket per key.
+type buckets struct {
+	limit rate.Limit
+	burst int
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	pruned  time.Time
+}
+
+type bucket struct {
+	lim  *rate.Limiter
+	used time.Time
+}
+
+func newBuckets(limit rate.Limit, burst int) *buckets {
+	if limit <= 0 {
+		return nil
+	}
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &buckets{
+		limit:   limit,
+		burst:   burst,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// take takes a token from the bucket of key. If there is none, it
+// returns how long to wait for one.
+func (b *buckets) take(key string) (bool, time.Duration) {
+	if b == nil {
+		return true, 0
+	}
+
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if now.Sub(b.pruned) > bucketIdle {
+		for k, bk := range b.buckets {
+			if now.Sub(bk.used) > bucketIdle {
+				delete(b.buckets, k)
+			}
+		}
+		b.pruned = now
+	}
+
+	bk, ok := b.buckets[key]
+	if !ok {
+		bk = &bucket{lim: rate.NewLimiter(b.limit, b.burst)}
+		b.buckets[key] = bk
+	}
+	bk.used = now
+
+	r := bk.lim.ReserveN(now, 1)
+	if d := r.DelayFrom(now); d > 0 {
+		r.CancelAt(now)
+		return false, d
+	}
+
+	return true, 0
+}
+
+// nameRateError is returned when a certificate for name would be ordered
+// faster than RateLimits.PerName allows.
+type nameRateError struct {
+	name  string
+	retry time.Duration
+}
+
+func (e *nameRateError) Error() string {
+	return fmt.Sprintf("achmed: too many orders for %q, retry in %s", e.name, e.retry)
+}
+
+// takeOrder takes a token from the bucket of every name a certificate is
+// about to be ordered for.
+func (a *AchmedServer) takeOrder(names []string) error {
+	for _, name := range names {
+		name = normalizeHost(name)
+		if ok, d := a.names.take(name); !ok {
+			return &nameRateError{name: name, retry: d}
+		}
+	}
+	return nil
+}
+
+// orderPolicy wraps policy to also take a token for the host, as autocert
+// only consults its host policy before ordering a certificate and when
+// answering HTTP-01 challenges.
+func (a *AchmedServer) orderPolicy(policy autocert.HostPolicy) autocert.HostPolicy {
+	return func(ctx context.Context, host string) error {
+		if policy != nil {
+			if err := policy(ctx, host); err != nil {
+				return err
+			}
+		}
+
+		if ctx.Value(challengeKey{}) != nil {
+			return nil
+		}
+
+		return a.takeOrder([]string{host})
+	}
+}
+
+// failureCache remembers failed certificate requests per certificate key.
+type failureCache struct {
+	ttl time.Duration
+
+	mu       sync.Mutex
+	failures map[string]failure
+}
+
+type failure struct {
+	err   error
+	until time.Time
+}
+
+func newFailureCache(ttl time.Duration) *failureCache {
+	return &failureCache{
+		ttl:      ttl,
+		failures: make(map[string]failure),
+	}
+}
+
+// get returns how long the recent failure for key is kept, and the failure.
+func (f *failureCache) get(key string) (time.Duration, error) {
+	if f == nil {
+		return 0, nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fl, ok := f.failures[key]
+	if !ok {
+		return 0, nil
+	}
+
+	d := fl.until.Sub(time.Now())
+	if d <= 0 {
+		delete(f.failures, key)
+		return 0, nil
+	}
+
+	return d, fl.err
+}
+
+func (f *failureCache) put(key string, err error) {
+	if f == nil {
+		return
+	}
+
+	now := time.Now()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for k, fl := range f.failures {
+		if now.After(fl.until) {
+			delete(f.failures, k)
+		}
+	}
+
+	f.failures[key] = failure{err: err, until: now.Add(f.ttl)}
+}
+
+// clientKey returns the key callers in ctx are rate limited by.
+func (a *AchmedServer) clientKey(ctx context.Context) string {
+	if a.auth != nil {
+		if id, err := a.auth.Identity(ctx); err == nil {
+			return id
+		}
+	}
+
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			return host
+		}
+		return p.Addr.String()
+	}
+
+	return ""
+}
+
+// UnaryInterceptor returns a gRPC interceptor enforcing the per client
+// rate limit. Rejected calls get a ResourceExhausted error with a
+// retry-after trailer.
+func (a *AchmedServer) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if ok, d := a.clients.take(a.clientKey(ctx)); !ok {
+			return nil, retryAfter(ctx, d, grpc.Errorf(codes.ResourceExhausted, "achmed: too many requests, retry in %s", d))
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// StreamInterceptor returns a gRPC interceptor enforcing the per client
+// rate limit on opening streams, see UnaryInterceptor.
+func (a *AchmedServer) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx := ss.Context()
+		if ok, d := a.clients.take(a.clientKey(ctx)); !ok {
+			return retryAfter(ctx, d, grpc.Errorf(codes.ResourceExhausted, "achmed: too many requests, retry in %s", d))
+		}
+
+		return handler(srv, ss)
+	}
+}
+
+// retryAfter sets the retry-after trailer of the call in ctx to d,
+// rounded up to whole seconds, and returns err.
+func retryAfter(ctx context.Context, d time.Duration, err error) error {
+	secs := int64(math.Ceil(d.Seconds()))
+	grpc.SetTrailer(ctx, metadata.Pairs(proto.RetryAfterKey, strconv.FormatInt(secs, 10)))
+	return err
+}
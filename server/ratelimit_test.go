@@ -0,0 +1,170 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/offblast/achmed/proto"
+)
+
+func TestBuckets(t *testing.T) {
+	b := newBuckets(rate.Every(time.Hour), 2)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := b.take("a"); !ok {
+			t.Fatalf("expected token %d within burst", i)
+		}
+	}
+
+	ok, d := b.take("a")
+	if ok || d <= 0 || d > time.Hour {
+		t.Fatalf("expected rejection with retry hint, got %v, %s", ok, d)
+	}
+
+	if ok, _ := b.take("b"); !ok {
+		t.Fatalf("expected separate bucket per key")
+	}
+
+	var none *buckets
+	if ok, _ := none.take("a"); !ok {
+		t.Fatalf("expected no limit without buckets")
+	}
+}
+
+func TestFailureCache(t *testing.T) {
+	f := newFailureCache(time.Hour)
+	f.put("example.com", errors.New("boom"))
+
+	if d, err := f.get("example.com"); err == nil || d <= 0 {
+		t.Fatalf("expected cached failure, got %v, %s", err, d)
+	}
+
+	if _, err := f.get("example.com+rsa"); err != nil {
+		t.Fatalf("expected no failure for other key, got %v", err)
+	}
+
+	f.failures["example.com"] = failure{err: errors.New("boom"), until: time.Now().Add(-time.Second)}
+	if _, err := f.get("example.com"); err != nil {
+		t.Fatalf("expected expired failure to be dropped, got %v", err)
+	}
+}
+
+func TestUnaryInterceptor(t *testing.T) {
+	a := &AchmedServer{}
+	WithRateLimits(RateLimits{
+		PerClient:   rate.Every(time.Hour),
+		ClientBurst: 3,
+		PerName:     rate.Every(time.Hour),
+		NameBurst:   1,
+	})(a)
+
+	a.auth = &Authorizer{Tokens: map[string]string{"s3cret": "web"}}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer s3cret"))
+
+	intercept := a.UnaryInterceptor()
+	info := &grpc.UnaryServerInfo{FullMethod: "/proto.Achmed/GetCertificate"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "ok", nil
+	}
+
+	call := func(name string, protos ...string) error {
+		_, err := intercept(ctx, &proto.ClientHelloInfo{Servername: name, Supportedprotos: protos}, info, handler)
+		return err
+	}
+
+	// certificate lookups are not limited per name.
+	for i := 0; i < 2; i++ {
+		if err := call("example.com"); err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+	}
+
+	if err := call("example.com", "acme-tls/1"); err != nil {
+		t.Fatalf("expected nil error for challenge, got %v", err)
+	}
+
+	if err := call("example.org"); grpc.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted for client, got %v", err)
+	}
+}
+
+func TestNameRateLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "achmed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := newTestOrderACME(t, "example.com")
+	defer srv.Close()
+	srv.validate = func(typ, name, token string) bool { return true }
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	c := autocert.DirCache(dir)
+
+	a, err := New("", c, &acme.Client{Key: key, DirectoryURL: srv.URL + "/directory"}, nil, WithRenewal(Renewal{Before: time.Hour}), WithRateLimits(RateLimits{
+		PerName:    rate.Every(time.Hour),
+		NameBurst:  1,
+		FailureTTL: time.Minute,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hello := &proto.ClientHelloInfo{Servername: "example.com", Ciphersuites: []uint32{0xc02b}, Supportedcurves: []uint32{23}}
+
+	// lookups of the ordered certificate don't count.
+	for i := 0; i < 3; i++ {
+		if _, err := a.GetCertificate(ctx, hello); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if srv.numOrders() != 1 {
+		t.Fatalf("expected one order, got %d", srv.numOrders())
+	}
+
+	a.issuer.forget("example.com")
+	if err := c.Delete(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.GetCertificate(ctx, hello); grpc.Code(err) != codes.ResourceExhausted || srv.numOrders() != 1 {
+		t.Fatalf("expected second order to be limited, got %v after %d orders", err, srv.numOrders())
+	}
+
+	if _, err := a.failures.get("example.com"); err != nil {
+		t.Fatalf("expected rate limited order not to be remembered as failure, got %v", err)
+	}
+
+	// autocert orders are limited through its host policy, challenge
+	// lookups are not.
+	if err := a.m.HostPolicy(ctx, "example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.m.HostPolicy(context.WithValue(ctx, challengeKey{}, true), "example.org"); err != nil {
+		t.Fatalf("expected challenge lookup not to be limited, got %v", err)
+	}
+	if err := a.m.HostPolicy(ctx, "example.org"); err == nil {
+		t.Fatalf("expected second autocert order to be limited")
+	}
+}
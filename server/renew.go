@@ -0,0 +1,339 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+)
+
+// Renewal configures renewing cached certificates in the background, see
+// AchmedServer.Renew.
+type Renewal struct {
+	// Before is how long before expiry certificates are renewed. If zero,
+	// 30 days are used.
+	Before time.Duration
+
+	// Jitter spreads renewals over up to this much time before Before,
+	// so certificates issued together are not renewed together.
+	Jitter time.Duration
+
+	// Interval is how often the cache is scanned. If zero, hourly.
+	Interval time.Duration
+
+	// Backoff is the wait before retrying a failed renewal, doubled after
+	// each further failure up to MaxBackoff. If zero, a minute and six
+	// hours are used.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// Lister is implemented by caches that can list their keys, like the
+// caches of package cache.
+type Lister interface {
+	List(ctx context.Context) ([]string, error)
+}
+
+// WithRenewal makes the server obtain all certificates itself, so that
+// Renew can renew them before they expire, whether they are requested or
+// not.
+func WithRenewal(r Renewal) Option {
+	return func(a *AchmedServer) {
+		if r.Before <= 0 {
+			r.Before = defaultRenewBefore
+		}
+		if r.Interval <= 0 {
+			r.Interval = time.Hour
+		}
+		if r.Backoff <= 0 {
+			r.Backoff = time.Minute
+		}
+		if r.MaxBackoff <= 0 {
+			r.MaxBackoff = 6 * time.Hour
+		}
+		a.renewal = &r
+	}
+}
+
+// Renew renews the certificates in the cache that are due for renewal
+// until ctx is done. With a Locker, each certificate is renewed by one
+// replica only. It needs WithRenewal and a cache implementing Lister.
+func (a *AchmedServer) Renew(ctx context.Context) error {
+	if a.renewal == nil {
+		return errors.New("achmed: no renewal configured")
+	}
+
+	lister, ok := a.cache.(Lister)
+	if !ok {
+		return errors.New("achmed: renewal needs a cache that can list its keys")
+	}
+
+	r := &renewer{
+		Renewal: *a.renewal,
+		cache:   a.cache,
+		lister:  lister,
+		names:   a.renewalNames,
+		renew:   a.issuer.renewNow,
+		now:     time.Now,
+		retries: make(map[string]*retry),
+	}
+
+	for {
+		t := time.NewTimer(r.scan(ctx))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// renewalNames returns the names to renew the certificate stored under key
+// for, or nil if it should be left to expire.
+func (a *AchmedServer) renewalNames(ctx context.Context, key string, leaf *x509.Certificate) []string {
+	dnsNames := leaf.DNSNames
+
+	if name := strings.TrimSuffix(key, "+rsa"); strings.HasSuffix(name, "+bundle") {
+		dnsNames = nil
+		for _, b := range a.bundleList {
+			if b.Name+"+bundle" == name {
+				dnsNames = b.Names
+			}
+		}
+	}
+
+	names := make([]string, 0, len(dnsNames))
+	for _, name := range dnsNames {
+		name = normalizeHost(name)
+		if strings.HasPrefix(name, "*.") {
+			if a.dns == nil {
+				return nil
+			}
+		} else if a.hostPolicy != nil {
+			if err := a.hostPolicy(ctx, name); err != nil {
+				return nil
+			}
+		}
+		names = append(names, name)
+	}
+
+	return names
+}
+
+// retry is the state of a certificate whose renewal failed.
+type retry struct {
+	failures int
+	next     time.Time
+}
+
+type renewer struct {
+	Renewal
+
+	cache  autocert.Cache
+	lister Lister
+
+	names func(ctx context.Context, key string, leaf *x509.Certificate) []string
+	renew func(ctx context.Context, key string, names []string, useRSA bool, old *tls.Certificate) error
+	now   func() time.Time
+
+	// retries holds the certificates whose last renewal failed.
+	retries map[string]*retry
+}
+
+// dueAt returns when the certificate stored under key is renewed. The
+// jitter is derived from key and serial number, so all replicas agree.
+func (r *renewer) dueAt(key string, leaf *x509.Certificate) time.Time {
+	at := leaf.NotAfter.Add(-r.Before)
+
+	if r.Jitter > 0 {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write(leaf.SerialNumber.Bytes())
+		at = at.Add(-time.Duration(h.Sum64() % uint64(r.Jitter)))
+	}
+
+	return at
+}
+
+// backoff returns the wait after the given number of failures.
+func (r *renewer) backoff(failures int) time.Duration {
+	d := r.Backoff
+	for n := 1; n < failures && d < r.MaxBackoff; n++ {
+		d *= 2
+	}
+	if d > r.MaxBackoff {
+		d = r.MaxBackoff
+	}
+	return d
+}
+
+// scan renews the certificates that are due, and returns how long to wait
+// before the next scan.
+func (r *renewer) scan(ctx context.Context) time.Duration {
+	wait := r.Interval
+
+	keys, err := r.lister.List(ctx)
+	if err != nil {
+		log.Printf("achmed: failed to list certificates: %v", err)
+		return wait
+	}
+
+	seen := make(map[string]bool)
+
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			break
+		}
+
+		// TLS-ALPN-01 challenge certificates.
+		if strings.HasSuffix(key, "+token") {
+			continue
+		}
+
+		data, err := r.cache.Get(ctx, key)
+		if err != nil {
+			continue
+		}
+
+		cert, err := parseCertificatePEM(data)
+		if err != nil {
+			// not a certificate.
+			continue
+		}
+
+		names := r.names(ctx, key, cert.Leaf)
+		if len(names) == 0 {
+			continue
+		}
+		seen[key] = true
+
+		now := r.now()
+		at := r.dueAt(key, cert.Leaf)
+		if rt, ok := r.retries[key]; ok && rt.next.After(at) {
+			at = rt.next
+		}
+
+		if at.After(now) {
+			if d := at.Sub(now); d < wait {
+				wait = d
+			}
+			continue
+		}
+
+		rctx, cancel := context.WithTimeout(ctx, issueTimeout)
+		err = r.renew(rctx, key, names, strings.HasSuffix(key, "+rsa"), cert)
+		cancel()
+
+		if err == nil {
+			delete(r.retries, key)
+			continue
+		}
+
+		rt, ok := r.retries[key]
+		if !ok {
+			rt = &retry{}
+			r.retries[key] = rt
+		}
+		rt.failures++
+		d := r.backoff(rt.failures)
+		rt.next = r.now().Add(d)
+
+		log.Printf("achmed: failed to renew certificate %q, retry in %s: %v", key, d, err)
+
+		if d < wait {
+			wait = d
+		}
+	}
+
+	for key := range r.retries {
+		if !seen[key] {
+			delete(r.retries, key)
+		}
+	}
+
+	if wait < time.Second {
+		wait = time.Second
+	}
+
+	return wait
+}
+
+// renewalAttempt is the last attempt to renew a certificate.
+type renewalAttempt struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error,omitempty"`
+}
+
+// renewalLog records the last renewal attempt of each certificate in an
+// autocert.Cache under "<key>+renewal", so that all replicas sharing the
+// cache can report it.
+//
+// Without a cache the attempts are only kept in memory.
+type renewalLog struct {
+	cache autocert.Cache
+
+	mu       sync.Mutex
+	attempts map[string]renewalAttempt
+}
+
+func newRenewalLog(cache autocert.Cache) *renewalLog {
+	return &renewalLog{cache: cache, attempts: make(map[string]renewalAttempt)}
+}
+
+// record records an attempt to renew the certificate stored under key,
+// which failed with err if it is not nil.
+func (l *renewalLog) record(ctx context.Context, key string, err error) {
+	ra := renewalAttempt{Time: time.Now()}
+	if err != nil {
+		ra.Error = err.Error()
+	}
+
+	if l.cache == nil {
+		l.mu.Lock()
+		l.attempts[key] = ra
+		l.mu.Unlock()
+		return
+	}
+
+	data, err := json.Marshal(ra)
+	if err != nil {
+		return
+	}
+
+	if err := l.cache.Put(ctx, key+"+renewal", data); err != nil {
+		log.Printf("achmed: failed to record renewal of %q: %v", key, err)
+	}
+}
+
+// last returns the last attempt to renew the certificate stored under key.
+func (l *renewalLog) last(ctx context.Context, key string) (renewalAttempt, bool) {
+	if l.cache == nil {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		ra, ok := l.attempts[key]
+		return ra, ok
+	}
+
+	var ra renewalAttempt
+
+	data, err := l.cache.Get(ctx, key+"+renewal")
+	if err != nil {
+		return ra, false
+	}
+
+	if err := json.Unmarshal(data, &ra); err != nil {
+		return ra, false
+	}
+
+	return ra, true
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+)
+
+// listCache is a DirCache listing a fixed set of keys.
+type listCache struct {
+	autocert.DirCache
+	keys []string
+}
+
+func (c *listCache) List(ctx context.Context) ([]string, error) {
+	return c.keys, nil
+}
+
+func TestRenewerDueAt(t *testing.T) {
+	leaf := selfSigned(t, "example.com").Leaf
+
+	r := &renewer{Renewal: Renewal{Before: 30 * 24 * time.Hour}}
+	if at := r.dueAt("example.com", leaf); !at.Equal(leaf.NotAfter.Add(-r.Before)) {
+		t.Fatalf("expected renewal at %v without jitter, got %v", leaf.NotAfter.Add(-r.Before), at)
+	}
+
+	r.Jitter = 24 * time.Hour
+	at := r.dueAt("example.com", leaf)
+	if at.After(leaf.NotAfter.Add(-r.Before)) || !at.After(leaf.NotAfter.Add(-r.Before-r.Jitter)) {
+		t.Fatalf("expected renewal within jitter, got %v", at)
+	}
+	if again := r.dueAt("example.com", leaf); !again.Equal(at) {
+		t.Fatalf("expected the same renewal time, got %v and %v", at, again)
+	}
+}
+
+func TestRenewerBackoff(t *testing.T) {
+	r := &renewer{Renewal: Renewal{Backoff: time.Minute, MaxBackoff: 5 * time.Minute}}
+
+	for n, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute} {
+		failures := n + 1
+		if d := r.backoff(failures); d != want {
+			t.Errorf("expected backoff %s after %d failures, got %s", want, failures, d)
+		}
+	}
+}
+
+func TestRenewerScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "achmed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	c := &listCache{DirCache: autocert.DirCache(dir)}
+
+	put := func(key string, cert *tls.Certificate) {
+		data, err := certificatePEM(cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Put(ctx, key, data); err != nil {
+			t.Fatal(err)
+		}
+		c.keys = append(c.keys, key)
+	}
+
+	soon := time.Now().Add(10 * 24 * time.Hour)
+	put("fresh.example.com", selfSigned(t, "fresh.example.com"))
+	put("due.example.com", selfSignedUntil(t, soon, "due.example.com"))
+	put("due.example.com+rsa", selfSignedUntil(t, soon, "due.example.com"))
+	put("due.example.com+token", selfSignedUntil(t, soon, "due.example.com"))
+	put("denied.example.com", selfSignedUntil(t, soon, "denied.example.com"))
+	if err := c.Put(ctx, "example.com+issuances", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	c.keys = append(c.keys, "example.com+issuances")
+
+	now := time.Now()
+	var renewed []string
+
+	r := &renewer{
+		Renewal: Renewal{
+			Before:     30 * 24 * time.Hour,
+			Interval:   time.Hour,
+			Backoff:    time.Minute,
+			MaxBackoff: time.Hour,
+		},
+		cache:  c,
+		lister: c,
+		names: func(ctx context.Context, key string, leaf *x509.Certificate) []string {
+			if leaf.DNSNames[0] == "denied.example.com" {
+				return nil
+			}
+			return leaf.DNSNames
+		},
+		renew: func(ctx context.Context, key string, names []string, useRSA bool, old *tls.Certificate) error {
+			renewed = append(renewed, key)
+			if useRSA {
+				return errors.New("failed")
+			}
+			data, err := certificatePEM(selfSigned(t, names...))
+			if err != nil {
+				return err
+			}
+			return c.Put(ctx, key, data)
+		},
+		now:     func() time.Time { return now },
+		retries: make(map[string]*retry),
+	}
+
+	wait := r.scan(ctx)
+	sort.Strings(renewed)
+	if len(renewed) != 2 || renewed[0] != "due.example.com" || renewed[1] != "due.example.com+rsa" {
+		t.Fatalf("expected due certificates to be renewed, got %v", renewed)
+	}
+	if wait != time.Minute {
+		t.Fatalf("expected a retry after a minute, got %s", wait)
+	}
+
+	// the failed renewal is not retried before its backoff.
+	renewed = nil
+	if wait := r.scan(ctx); len(renewed) != 0 || wait != time.Minute {
+		t.Fatalf("expected no renewals for a minute, got %v and %s", renewed, wait)
+	}
+
+	now = now.Add(time.Minute)
+	if wait := r.scan(ctx); len(renewed) != 1 || renewed[0] != "due.example.com+rsa" || wait != 2*time.Minute {
+		t.Fatalf("expected a retry with doubled backoff, got %v and %s", renewed, wait)
+	}
+}
+
+func TestRenewalLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "achmed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+
+	for _, cache := range []autocert.Cache{nil, autocert.DirCache(dir)} {
+		l := newRenewalLog(cache)
+
+		if _, ok := l.last(ctx, "example.com"); ok {
+			t.Fatalf("expected no renewal attempt")
+		}
+
+		l.record(ctx, "example.com", errors.New("failed"))
+		if ra, ok := l.last(ctx, "example.com"); !ok || ra.Error != "failed" || time.Since(ra.Time) > time.Minute {
+			t.Fatalf("expected failed renewal attempt, got %+v", ra)
+		}
+
+		l.record(ctx, "example.com", nil)
+		if ra, ok := l.last(ctx, "example.com"); !ok || ra.Error != "" {
+			t.Fatalf("expected successful renewal attempt, got %+v", ra)
+		}
+	}
+}
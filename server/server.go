@@ -1,29 +1,111 @@
 package server
 
 import (
-	"bytes"
-	"crypto/ecdsa"
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
+	"crypto/tls"
+	"errors"
 	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/net/context"
+	"golang.org/x/sync/singleflight"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 
 	"github.com/offblast/achmed/proto"
 )
 
 type AchmedServer struct {
 	m *autocert.Manager
+
+	// cache is the certificate cache, without wrappers.
+	cache autocert.Cache
+
+	// hostPolicy is checked before any certificate is looked up.
+	hostPolicy autocert.HostPolicy
+
+	// auth, if set, restricts which names each caller may request.
+	auth *Authorizer
+
+	// limits and issuances, if set, keep issuance below weekly limits.
+	limits    *Limits
+	issuances *issuanceLog
+
+	// clients and names rate limit calls per caller and server name,
+	// failures remembers names that recently failed.
+	clients  *buckets
+	names    *buckets
+	failures *failureCache
+
+	// dns and issuer, if set, obtain certificates with DNS-01 challenges
+	// instead of m.
+	dns    DNSProvider
+	issuer *issuer
+
+	// renewal, if set, makes the issuer obtain all certificates, so that
+	// Renew can renew them.
+	renewal *Renewal
+
+	// identities, if set, maps server names to the certificate they get.
+	identities IdentityMap
+
+	// bundles maps the names of bundles to their bundle.
+	bundleList []Bundle
+	bundles    map[string]*Bundle
+
+	// locker, if set, serializes ordering and renewing certificates across
+	// replicas.
+	// served records until when the certificates served under a key need
+	// no more locking,
+	// replaced those of certificates revoked or renewed through the Admin
+	// service, which a.issuer serves since autocert would keep serving the
+	// old ones. replacedChecked is when the cache was last asked whether a
+	// certificate was replaced by another replica.
+	locker          Locker
+	mu              sync.Mutex
+	served          map[string]time.Time
+	replaced        map[string]bool
+	replacedChecked map[string]time.Time
+
+	// challenges answers HTTP-01 challenge requests from m's token store.
+	challenges http.Handler
+
+	// group coalesces concurrent requests for the same certificate.
+	group singleflight.Group
+
+	// watchers are the streams watching certificates.
+	watchers *watchHub
+
+	encoded *encodedCerts
+}
+
+// Option configures an AchmedServer.
+type Option func(*AchmedServer)
+
+// WithAuthorizer makes GetCertificate reject callers that auth does not
+// allow to request the name.
+func WithAuthorizer(auth *Authorizer) Option {
+	return func(a *AchmedServer) {
+		a.auth = auth
+	}
+}
+
+// WithLimits makes the server refuse to order certificates that would go
+// over limits. Issued certificates are counted in the certificate cache.
+func WithLimits(limits Limits) Option {
+	return func(a *AchmedServer) {
+		a.limits = &limits
+	}
 }
 
 // New creates a new AchmedServer.
 //
 // See https://godoc.org/golang.org/x/crypto/acme/autocert#Manager for argument details.
-func New(email string, cache autocert.Cache, client *acme.Client, hostpolicy autocert.HostPolicy) (*AchmedServer, error) {
+func New(email string, cache autocert.Cache, client *acme.Client, hostpolicy autocert.HostPolicy, opts ...Option) (*AchmedServer, error) {
 	m := &autocert.Manager{
 		Prompt:     autocert.AcceptTOS,
 		Cache:      cache,
@@ -32,47 +114,274 @@ func New(email string, cache autocert.Cache, client *acme.Client, hostpolicy aut
 		Email:      email,
 	}
 
-	return &AchmedServer{m}, nil
+	a := &AchmedServer{
+		m:               m,
+		cache:           cache,
+		hostPolicy:      hostpolicy,
+		challenges:      m.HTTPHandler(http.NotFoundHandler()),
+		encoded:         newEncodedCerts(),
+		watchers:        newWatchHub(),
+		served:          make(map[string]time.Time),
+		replaced:        make(map[string]bool),
+		replacedChecked: make(map[string]time.Time),
+	}
+
+	a.watchers.lookup = a.watchedFingerprint
+
+	for _, opt := range opts {
+		opt(a)
+	}
+
+	if a.limits != nil {
+		a.issuances = newIssuanceLog(cache, *a.limits)
+		m.Cache = &recordingCache{Cache: cache, log: a.issuances}
+		m.HostPolicy = a.issuances.hostPolicy(hostpolicy)
+	}
+
+	if a.names != nil {
+		m.HostPolicy = a.orderPolicy(m.HostPolicy)
+	}
+
+	bundles, err := bundleIndex(a.bundleList)
+	if err != nil {
+		return nil, err
+	}
+	a.bundles = bundles
+
+	if a.renewal != nil {
+		m.RenewBefore = a.renewal.Before
+	}
+
+	// the issuer also reissues revoked certificates.
+	if a.dns != nil || a.renewal != nil || len(a.bundles) > 0 || client != nil && client.Key != nil {
+		if a.issuer, err = newIssuer(m, a.dns, a.issuances); err != nil {
+			return nil, err
+		}
+		a.issuer.locker = a.locker
+		a.issuer.changed = a.watchers.notify
+		if a.names != nil {
+			a.issuer.limit = a.takeOrder
+		}
+	}
+
+	return a, nil
 }
 
+// GetCertificate returns the certificate for clientHello. An ECDSA
+// certificate is returned when the signature schemes, curves and cipher
+// suites the client advertised allow it, otherwise an RSA certificate.
+// Concurrent requests for the same server name and key type share one lookup.
+//
+// With rate limits, a failure is returned as a ResourceExhausted error to
+// further requests for the same name until it expires.
+//
+// Names rejected by the host policy or the authorizer get a
+// PermissionDenied error.
+//
+// Names in a Bundle get the certificate shared by the bundle.
+//
+// With an IdentityMap, the certificate of the identity a name maps to is
+// returned, e.g. a wildcard certificate shared by all hosts of a domain.
+//
+// Hellos advertising the "acme-tls/1" protocol get the TLS-ALPN-01 challenge
+// certificate for the name, so clients can answer challenges themselves.
 func (a *AchmedServer) GetCertificate(ctx context.Context, clientHello *proto.ClientHelloInfo) (*proto.Certificate, error) {
 	chi := proto.ProtoToClientHelloInfo(clientHello)
-	cert, err := a.m.GetCertificate(chi)
+
+	key, names, err := a.certificateFor(ctx, chi)
 	if err != nil {
-		log.Printf("achmed: failed to get certificate for %q: %v", chi.ServerName, err)
 		return nil, err
 	}
 
-	var pembuf bytes.Buffer
+	if d, err := a.failures.get(key); err != nil {
+		return nil, retryAfter(ctx, d, grpc.Errorf(codes.ResourceExhausted, "achmed: certificate for %q failed recently, retry in %s: %v", chi.ServerName, d, err))
+	}
+
+	v, err, _ := a.group.Do(key, func() (interface{}, error) {
+		return a.getCertificate(chi, key, names)
+	})
+	if err != nil {
+		if nr, ok := err.(*nameRateError); ok {
+			return nil, retryAfter(ctx, nr.retry, grpc.Errorf(codes.ResourceExhausted, "%v", err))
+		}
+
+		if !proto.WantsChallengeCert(chi) {
+			a.failures.put(key, err)
+		}
 
-	var pkey *pem.Block
+		if rl, ok := err.(*RateLimitError); ok {
+			return nil, retryAfter(ctx, rl.RetryAfter.Sub(time.Now()), grpc.Errorf(codes.ResourceExhausted, "%v", err))
+		}
+		return nil, err
+	}
+
+	return v.(*proto.Certificate), nil
+}
 
-	switch t := cert.PrivateKey.(type) {
-	case *rsa.PrivateKey:
-		pkey = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(t)}
-	case *ecdsa.PrivateKey:
-		pkeyb, err := x509.MarshalECPrivateKey(t)
+// certificateFor checks that the caller in ctx may get a certificate for
+// chi, and for every name it covers, and returns the cache key of the
+// certificate. It also returns the
+// names a.issuer issues the certificate for, nil if autocert does.
+// chi.ServerName is normalized, and with an IdentityMap replaced by the
+// name's identity.
+func (a *AchmedServer) certificateFor(ctx context.Context, chi *tls.ClientHelloInfo) (string, []string, error) {
+	// names differing in case share a certificate.
+	chi.ServerName = normalizeHost(chi.ServerName)
+
+	if err := a.authorize(ctx, chi.ServerName); err != nil {
+		return "", nil, err
+	}
+
+	if a.hostPolicy != nil {
+		if err := a.hostPolicy(ctx, chi.ServerName); err != nil {
+			return "", nil, grpc.Errorf(codes.PermissionDenied, "achmed: host %q not allowed: %v", chi.ServerName, err)
+		}
+	}
+
+	key := proto.CertKey(chi)
+
+	if proto.WantsChallengeCert(chi) {
+		return key, nil, nil
+	}
+
+	if b, ok := a.bundles[normalizeHost(chi.ServerName)]; ok {
+		// the key of the bundle's certificate is good for all its names.
+		for _, name := range b.Names {
+			if err := a.authorize(ctx, name); err != nil {
+				return "", nil, err
+			}
+		}
+
+		return b.key(!proto.SupportsECDSA(chi)), b.Names, nil
+	}
+
+	if a.identities != nil {
+		// certificates are looked up, issued and cached by identity.
+		name := a.identities(chi.ServerName)
+		if strings.HasPrefix(name, "*.") && a.dns == nil {
+			return "", nil, grpc.Errorf(codes.FailedPrecondition, "achmed: host %q maps to %q, which needs DNS-01", chi.ServerName, name)
+		}
+
+		// the key of a wildcard certificate is good for all its names.
+		if err := a.authorize(ctx, name); err != nil {
+			return "", nil, err
+		}
+		chi.ServerName = name
+		key = proto.CertKey(chi)
+	}
+
+	// with a locker, renewals also need to take turns.
+	if a.dns != nil || a.renewal != nil || a.issuer != nil && (a.locker != nil || a.wasReplaced(ctx, key)) {
+		return key, []string{chi.ServerName}, nil
+	}
+
+	return key, nil, nil
+}
+
+// authorize checks that the caller in ctx may get certificates for name.
+func (a *AchmedServer) authorize(ctx context.Context, name string) error {
+	if a.auth == nil {
+		return nil
+	}
+
+	if err := a.auth.Authorize(ctx, name); err != nil {
+		return grpc.Errorf(codes.PermissionDenied, "achmed: host %q not allowed for caller: %v", name, err)
+	}
+
+	return nil
+}
+
+// getCertificate returns the certificate for chi, stored under key. If
+// names is set, the certificate is issued for names by a.issuer, else by
+// autocert.
+func (a *AchmedServer) getCertificate(chi *tls.ClientHelloInfo, key string, names []string) (*proto.Certificate, error) {
+	if proto.WantsChallengeCert(chi) {
+		// autocert only hands out TLS-ALPN-01 challenge certificates to
+		// hellos offering nothing but acme-tls/1.
+		chi.SupportedProtos = []string{acme.ALPNProto}
+	}
+
+	var cert *tls.Certificate
+	var err error
+
+	if proto.WantsChallengeCert(chi) && a.issuer != nil {
+		if cert, ok := a.issuer.challengeCert(chi.ServerName); ok {
+			return certificateToProto(cert)
+		}
+	}
+
+	// the issuer takes the locks it needs itself.
+	if !proto.WantsChallengeCert(chi) && names == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), issueTimeout)
+		defer cancel()
+
+		unlock, err := a.lockIssuance(ctx, key, chi.ServerName)
 		if err != nil {
+			log.Printf("achmed: failed to lock %q: %v", key, err)
 			return nil, err
 		}
-
-		pkey = &pem.Block{Type: "EC PRIVATE KEY", Bytes: pkeyb}
-	default:
-		return nil, x509.ErrUnsupportedAlgorithm
+		defer unlock()
 	}
 
-	if err := pem.Encode(&pembuf, pkey); err != nil {
+	if names != nil {
+		cert, err = a.issuer.GetCertificate(key, names, !proto.SupportsECDSA(chi))
+	} else {
+		cert, err = a.m.GetCertificate(chi)
+	}
+	if err != nil {
+		log.Printf("achmed: failed to get certificate for %q: %v", chi.ServerName, err)
 		return nil, err
 	}
 
-	for _, b := range cert.Certificate {
-		pb := &pem.Block{Type: "CERTIFICATE", Bytes: b}
-		if err := pem.Encode(&pembuf, pb); err != nil {
-			return nil, err
+	// challenge certificates are only used once, don't keep their encoding.
+	if proto.WantsChallengeCert(chi) {
+		return certificateToProto(cert)
+	}
+
+	a.markServed(key, cert)
+
+	return a.encoded.get(key, cert)
+}
+
+// GetHTTPChallenge returns the key authorization for an HTTP-01 challenge
+// token, so that clients can answer challenges for the names they serve.
+func (a *AchmedServer) GetHTTPChallenge(ctx context.Context, req *proto.HTTPChallengeRequest) (*proto.HTTPChallengeResponse, error) {
+	if req.Host == "" || req.Token == "" || strings.Contains(req.Token, "/") {
+		return nil, grpc.Errorf(codes.InvalidArgument, "achmed: invalid challenge request")
+	}
+
+	if a.issuer != nil {
+		if resp, ok := a.issuer.httpToken(req.Token); ok {
+			return &proto.HTTPChallengeResponse{Keyauthorization: resp}, nil
 		}
 	}
 
-	return &proto.Certificate{Pem: pembuf.Bytes()}, nil
+	hreq, err := http.NewRequest("GET", "http://"+req.Host+challengePath+req.Token, nil)
+	if err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "achmed: invalid challenge request: %v", err)
+	}
+
+	var w challengeWriter
+	a.challenges.ServeHTTP(&w, hreq.WithContext(context.WithValue(ctx, challengeKey{}, true)))
+
+	switch w.code {
+	case http.StatusOK:
+		return &proto.HTTPChallengeResponse{Keyauthorization: w.body.Bytes()}, nil
+	case http.StatusForbidden:
+		return nil, grpc.Errorf(codes.PermissionDenied, "achmed: host %q not allowed", req.Host)
+	default:
+		return nil, grpc.Errorf(codes.NotFound, "achmed: no challenge for token %q", req.Token)
+	}
+}
+
+// Budget returns the remaining weekly issuance budget of the registered
+// domain of name. It fails if the server has no limits configured.
+func (a *AchmedServer) Budget(ctx context.Context, name string) (*Budget, error) {
+	if a.issuances == nil {
+		return nil, errors.New("achmed: no issuance limits configured")
+	}
+
+	return a.issuances.budget(ctx, name)
 }
 
 func (a *AchmedServer) Register(serv *grpc.Server) {
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"crypto/tls"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/offblast/achmed/proto"
+)
+
+const (
+	// watchInterval is how often watched certificates are looked up in
+	// the cache, to notice changes made by other replicas.
+	watchInterval = time.Minute
+
+	// maxWatches bounds the certificates watched by one stream.
+	maxWatches = 1000
+)
+
+// watchHub tells streams watching certificates that one of them changed,
+// on this server or, found by polling the cache once per key, on another
+// replica.
+type watchHub struct {
+	mu   sync.Mutex
+	subs map[string]map[chan struct{}]bool
+
+	// lookup returns the fingerprint of the certificate stored under key,
+	// "" if there is none. Without it, keys aren't polled.
+	lookup func(key string) string
+
+	// polled holds the fingerprints poll last saw.
+	polled map[string]string
+
+	// stop ends poll, nil if it isn't running.
+	stop chan struct{}
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{subs: make(map[string]map[chan struct{}]bool), polled: make(map[string]string)}
+}
+
+// subscribe returns a channel that receives a value whenever a
+// certificate stored under one of keys changes.
+func (h *watchHub) subscribe(keys []string) chan struct{} {
+	ch := make(chan struct{}, 1)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, key := range keys {
+		if h.subs[key] == nil {
+			h.subs[key] = make(map[chan struct{}]bool)
+		}
+		h.subs[key][ch] = true
+	}
+
+	if h.stop == nil && h.lookup != nil {
+		h.stop = make(chan struct{})
+		go h.poll(h.stop)
+	}
+
+	return ch
+}
+
+func (h *watchHub) unsubscribe(ch chan struct{}, keys []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, key := range keys {
+		delete(h.subs[key], ch)
+		if len(h.subs[key]) == 0 {
+			delete(h.subs, key)
+			delete(h.polled, key)
+		}
+	}
+
+	if len(h.subs) == 0 && h.stop != nil {
+		close(h.stop)
+		h.stop = nil
+	}
+}
+
+// notify tells the subscribers of key that its certificate changed.
+func (h *watchHub) notify(key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.signal(key)
+}
+
+// signal wakes the subscribers of key. h.mu must be held.
+func (h *watchHub) signal(key string) {
+	for ch := range h.subs[key] {
+		// a pending value makes the subscriber look at all its keys.
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// poll checks the watched keys every watchInterval until stop is closed.
+func (h *watchHub) poll(stop chan struct{}) {
+	t := time.NewTicker(watchInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			h.check()
+		}
+	}
+}
+
+// check looks up each watched key once, however many streams watch it,
+// and notifies the subscribers of the keys whose certificate changed.
+// Keys seen for the first time are notified too, they may have changed
+// since their subscribers last looked.
+func (h *watchHub) check() {
+	h.mu.Lock()
+	keys := make([]string, 0, len(h.subs))
+	for key := range h.subs {
+		keys = append(keys, key)
+	}
+	h.mu.Unlock()
+
+	for _, key := range keys {
+		fp := h.lookup(key)
+
+		h.mu.Lock()
+		if _, ok := h.subs[key]; ok {
+			if old, seen := h.polled[key]; !seen || old != fp {
+				h.polled[key] = fp
+				h.signal(key)
+			}
+		}
+		h.mu.Unlock()
+	}
+}
+
+// watch is a certificate watched by a stream.
+type watch struct {
+	hello       *proto.ClientHelloInfo
+	key         string
+	fingerprint string
+}
+
+// WatchCertificates streams the certificates GetCertificate returns for
+// the watched hellos whenever they change, and notices when they are
+// revoked. Certificates the client does not hold yet are sent right away.
+//
+// Changes made by this server are sent immediately, changes made by other
+// replicas sharing the cache within a minute. Hellos the caller may not
+// get a certificate for are not watched.
+func (a *AchmedServer) WatchCertificates(req *proto.WatchRequest, stream proto.Achmed_WatchCertificatesServer) error {
+	ctx := stream.Context()
+
+	if len(req.Watches) == 0 || len(req.Watches) > maxWatches {
+		return grpc.Errorf(codes.InvalidArgument, "achmed: watch 1 to %d certificates", maxWatches)
+	}
+
+	var (
+		watches []*watch
+		keys    []string
+	)
+
+	for _, w := range req.Watches {
+		if w.Hello == nil {
+			return grpc.Errorf(codes.InvalidArgument, "achmed: watch without hello")
+		}
+
+		chi := proto.ProtoToClientHelloInfo(w.Hello)
+		if proto.WantsChallengeCert(chi) {
+			return grpc.Errorf(codes.InvalidArgument, "achmed: challenge certificates can't be watched")
+		}
+
+		key, _, err := a.certificateFor(ctx, chi)
+		if code := grpc.Code(err); code == codes.PermissionDenied || code == codes.FailedPrecondition {
+			// a name the caller may no longer get doesn't stop the others.
+			log.Printf("achmed: not watching %q: %v", w.Hello.Servername, err)
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		watches = append(watches, &watch{hello: w.Hello, key: key, fingerprint: w.Fingerprint})
+		keys = append(keys, key)
+	}
+
+	if len(watches) == 0 {
+		return grpc.Errorf(codes.PermissionDenied, "achmed: none of the watched certificates are allowed")
+	}
+
+	changed := a.watchers.subscribe(keys)
+	defer a.watchers.unsubscribe(changed, keys)
+
+	for {
+		for _, w := range watches {
+			if err := a.checkWatch(ctx, stream, w); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changed:
+		}
+	}
+}
+
+// checkWatch sends the current certificate of w if it is not the one the
+// client holds.
+func (a *AchmedServer) checkWatch(ctx context.Context, stream proto.Achmed_WatchCertificatesServer, w *watch) error {
+	cert := a.currentCertificate(ctx, w.key)
+
+	if cert == nil {
+		// without a cache, certificates only known to autocert can't be
+		// told apart from revoked ones.
+		if w.fingerprint == "" || a.cache == nil {
+			return nil
+		}
+
+		w.fingerprint = ""
+		return stream.Send(&proto.CertificateEvent{Hello: w.hello, Revoked: true})
+	}
+
+	fp := fingerprint(cert.Leaf.Raw)
+	if fp == w.fingerprint || time.Now().After(cert.Leaf.NotAfter) {
+		return nil
+	}
+
+	msg, err := a.encoded.get(w.key, cert)
+	if err != nil {
+		return grpc.Errorf(codes.Internal, "achmed: failed to encode certificate %q: %v", w.key, err)
+	}
+
+	if err := stream.Send(&proto.CertificateEvent{Hello: w.hello, Certificate: msg}); err != nil {
+		return err
+	}
+
+	w.fingerprint = fp
+	return nil
+}
+
+// watchedFingerprint returns the fingerprint of the certificate stored
+// under key, "" if there is none.
+func (a *AchmedServer) watchedFingerprint(key string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), watchInterval)
+	defer cancel()
+
+	if cert := a.currentCertificate(ctx, key); cert != nil {
+		return fingerprint(cert.Leaf.Raw)
+	}
+	return ""
+}
+
+// currentCertificate returns the certificate stored under key, from the
+// cache if possible, or nil if there is none.
+func (a *AchmedServer) currentCertificate(ctx context.Context, key string) *tls.Certificate {
+	if cert := a.cachedCertificate(ctx, key); cert != nil {
+		return cert
+	}
+
+	if a.issuer != nil {
+		return a.issuer.certificate(key)
+	}
+
+	return nil
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/offblast/achmed/proto"
+)
+
+// testWatchStream collects the events sent on a watch stream.
+type testWatchStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	events chan *proto.CertificateEvent
+}
+
+func (s *testWatchStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *testWatchStream) Send(ev *proto.CertificateEvent) error {
+	s.events <- ev
+	return nil
+}
+
+func TestWatchCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "achmed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := autocert.DirCache(dir)
+
+	put := func() string {
+		cert := selfSigned(t, "example.com")
+		data, err := certificatePEM(cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Put(ctx, "example.com", data); err != nil {
+			t.Fatal(err)
+		}
+		return fingerprint(cert.Leaf.Raw)
+	}
+
+	first := put()
+
+	a, err := New("", c, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hello := &proto.ClientHelloInfo{Servername: "example.com", Ciphersuites: []uint32{0xc02b}, Supportedcurves: []uint32{23}}
+
+	stream := &testWatchStream{ctx: ctx, events: make(chan *proto.CertificateEvent, 10)}
+	done := make(chan error, 1)
+	go func() {
+		done <- a.WatchCertificates(&proto.WatchRequest{Watches: []*proto.Watch{{Hello: hello}}}, stream)
+	}()
+
+	next := func() *proto.CertificateEvent {
+		select {
+		case ev := <-stream.events:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event received")
+			return nil
+		}
+	}
+
+	// the client holds no certificate yet.
+	if ev := next(); ev.Certificate == nil || ev.Certificate.Fingerprint != first || ev.Hello.Servername != "example.com" {
+		t.Fatalf("expected current certificate, got %+v", ev)
+	}
+
+	second := put()
+	a.watchers.notify("example.com")
+
+	if ev := next(); ev.Certificate == nil || ev.Certificate.Fingerprint != second {
+		t.Fatalf("expected renewed certificate, got %+v", ev)
+	}
+
+	if err := c.Delete(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	a.watchers.notify("example.com")
+
+	if ev := next(); !ev.Revoked || ev.Certificate != nil {
+		t.Fatalf("expected revocation notice, got %+v", ev)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(a.watchers.subs) != 0 {
+		t.Fatalf("expected stream to unsubscribe, got %v", a.watchers.subs)
+	}
+
+	if err := a.WatchCertificates(&proto.WatchRequest{}, stream); grpc.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected empty watch to be rejected, got %v", err)
+	}
+}
+
+func TestWatchCertificatesDenied(t *testing.T) {
+	dir, err := ioutil.TempDir("", "achmed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := autocert.DirCache(dir)
+
+	data, err := certificatePEM(selfSigned(t, "example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put(ctx, "example.com", data); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := New("", c, nil, (&HostRules{Exact: []string{"example.com"}}).HostPolicy())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowed := &proto.ClientHelloInfo{Servername: "example.com", Ciphersuites: []uint32{0xc02b}, Supportedcurves: []uint32{23}}
+	denied := &proto.ClientHelloInfo{Servername: "example.org", Ciphersuites: []uint32{0xc02b}, Supportedcurves: []uint32{23}}
+
+	stream := &testWatchStream{ctx: ctx, events: make(chan *proto.CertificateEvent, 10)}
+
+	if err := a.WatchCertificates(&proto.WatchRequest{Watches: []*proto.Watch{{Hello: denied}}}, stream); grpc.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected stream without allowed certificates to be denied, got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- a.WatchCertificates(&proto.WatchRequest{Watches: []*proto.Watch{{Hello: denied}, {Hello: allowed}}}, stream)
+	}()
+
+	select {
+	case ev := <-stream.events:
+		if ev.Hello.Servername != "example.com" || ev.Certificate == nil {
+			t.Fatalf("expected certificate for example.com, got %+v", ev)
+		}
+	case err := <-done:
+		t.Fatalf("expected denied name to be skipped, got %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no event received")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchHubCheck(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		fps     = map[string]string{"a": "1", "b": "2"}
+		lookups int
+	)
+
+	h := newWatchHub()
+	h.lookup = func(key string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		lookups++
+		return fps[key]
+	}
+
+	one := h.subscribe([]string{"a"})
+	two := h.subscribe([]string{"a", "b"})
+
+	pending := func(ch chan struct{}) bool {
+		select {
+		case <-ch:
+			return true
+		default:
+			return false
+		}
+	}
+
+	// keys seen for the first time are notified.
+	h.check()
+	if lookups != 2 || !pending(one) || !pending(two) {
+		t.Fatalf("expected one lookup per key and both streams notified, got %d lookups", lookups)
+	}
+
+	h.check()
+	if pending(one) || pending(two) {
+		t.Fatalf("expected no notification without a change")
+	}
+
+	mu.Lock()
+	fps["b"] = "3"
+	mu.Unlock()
+
+	h.check()
+	if pending(one) || !pending(two) {
+		t.Fatalf("expected only the watcher of b to be notified")
+	}
+
+	h.unsubscribe(one, []string{"a"})
+	h.unsubscribe(two, []string{"a", "b"})
+
+	if h.stop != nil || len(h.polled) != 0 {
+		t.Fatalf("expected polling to stop without watchers, got %v", h.polled)
+	}
+}